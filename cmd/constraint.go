@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	ct "github.com/mtyurt/coffeetable"
+	"github.com/mtyurt/coffeetable/repo"
+)
+
+func constraint(conf *ServerConfig, args []string) {
+	repo, closeRepo, err := openRepo(conf)
+	panicOnErr(err)
+	defer closeRepo()
+	scope := conf.scope()
+	switch {
+	case args[0] == "list":
+		constraints, err := repo.GetConstraints(scope)
+		panicOnErr(err)
+		for _, c := range constraints {
+			if c.Kind == ct.CONSTRAINT_PIN {
+				fmt.Printf("%d %s %s %d\n", c.ID, c.Kind, c.User1, c.Group)
+			} else {
+				fmt.Printf("%d %s %s %s\n", c.ID, c.Kind, c.User1, c.User2)
+			}
+		}
+	case args[0] == "add" && len(args) == 4 && (args[1] == ct.CONSTRAINT_APART || args[1] == ct.CONSTRAINT_TOGETHER):
+		members := channelMembers(conf, repo)
+		err = repo.AddConstraint(scope, ct.Constraint{Kind: args[1], User1: mustFindUserID(members, args[2]), User2: mustFindUserID(members, args[3])})
+		panicOnErr(err)
+	case args[0] == "add" && len(args) == 4 && args[1] == ct.CONSTRAINT_PIN:
+		group, err := strconv.Atoi(args[3])
+		if err != nil || group < 1 {
+			fmt.Println("Error! Group should be a positive number:", args[3])
+			exitWithUsage()
+		}
+		err = repo.AddConstraint(scope, ct.Constraint{Kind: args[1], User1: mustFindUserID(channelMembers(conf, repo), args[2]), Group: group})
+		panicOnErr(err)
+	case args[0] == "remove" && len(args) == 2:
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			fmt.Println("Error! Constraint id should be a number:", err)
+			exitWithUsage()
+		}
+		err = repo.RemoveConstraint(scope, id)
+		panicOnErr(err)
+	default:
+		exitWithUsage()
+	}
+}
+func channelMembers(conf *ServerConfig, r repo.Repo) []ct.User {
+	ctx, cancel := conf.slackContext()
+	defer cancel()
+	members, err := conf.slackService(r).GetChannelMembers(ctx)
+	panicOnErr(err)
+	return members
+}
+
+// mustFindUserID returns the ID of the member with the given ID or name.
+func mustFindUserID(members []ct.User, user string) string {
+	for _, u := range members {
+		if u.ID == user || u.Name == user {
+			return u.ID
+		}
+	}
+	fmt.Println("Error! No channel member has the ID or name:", user)
+	os.Exit(1)
+	return ""
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mtyurt/coffeetable/history"
+)
+
+// export writes relations or rounds to the file in args or to stdout.
+func export(conf *ServerConfig, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		exitWithUsage()
+	}
+	repo, closeRepo, err := openRepo(conf)
+	panicOnErr(err)
+	defer closeRepo()
+	data, err := history.Export(repo, conf.scope())
+	panicOnErr(err)
+	var w io.Writer = os.Stdout
+	if len(args) == 3 {
+		f, err := os.Create(args[2])
+		panicOnErr(err)
+		defer f.Close()
+		w = f
+	}
+	err = history.Write(w, args[0], args[1], data)
+	panicOnErr(err)
+}
+
+// importHistory merges relations or rounds from a file. Names are resolved to
+// the IDs of channel members, so Slack has to be configured, and users that
+// are not resolved fail the import unless allow-unknown is given. A dry run
+// only prints what would change.
+func importHistory(conf *ServerConfig, args []string) {
+	if len(args) < 3 {
+		exitWithUsage()
+	}
+	dryRun, allowUnknown := false, false
+	for _, option := range args[3:] {
+		switch {
+		case option == "dry-run" && !dryRun:
+			dryRun = true
+		case option == "allow-unknown" && !allowUnknown:
+			allowUnknown = true
+		default:
+			exitWithUsage()
+		}
+	}
+	if conf.SlackToken == "" && !allowUnknown {
+		fmt.Println("Error! Users cannot be resolved without a Slack token, import with allow-unknown to keep them as they are.")
+		os.Exit(1)
+	}
+	f, err := os.Open(args[2])
+	panicOnErr(err)
+	defer f.Close()
+	data, err := history.Read(f, args[0], args[1])
+	if err != nil {
+		fmt.Println("Error!", err)
+		os.Exit(1)
+	}
+	repo, closeRepo, err := openRepo(conf)
+	panicOnErr(err)
+	defer closeRepo()
+	unknown := []string{}
+	if conf.SlackToken != "" {
+		data, unknown = history.ResolveUsers(data, channelMembers(conf, repo))
+	}
+	report, err := history.Plan(repo, conf.scope(), data)
+	panicOnErr(err)
+	report.UnknownUsers = unknown
+	fmt.Print(report)
+	if len(unknown) > 0 && !allowUnknown {
+		fmt.Println("Error! Users not in the channel cannot be imported, fix them or import with allow-unknown to keep them as they are.")
+		os.Exit(1)
+	}
+	if dryRun {
+		fmt.Println("Dry run, nothing is changed.")
+		return
+	}
+	err = history.Apply(repo, conf.scope(), report)
+	panicOnErr(err)
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	ct "github.com/mtyurt/coffeetable"
 
 	"github.com/go-yaml/yaml"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/mtyurt/coffeetable/repo"
 	"github.com/mtyurt/coffeetable/slackhelper"
@@ -16,45 +22,371 @@ import (
 )
 
 type ServerConfig struct {
-	SlackToken     string `yaml:"slackToken"`
-	SlackChannel   string `yaml:"slackChannel"`
-	PrivateChannel bool   `yaml:"privateChannel"`
-	DatabasePath   string `yaml:"databasePath"`
+	SlackToken     string        `yaml:"slackToken"`
+	SlackChannel   string        `yaml:"slackChannel"`
+	DatabasePath   string        `yaml:"databasePath"`
+	DatabaseDriver string        `yaml:"databaseDriver"`
+	DatabaseDSN    string        `yaml:"databaseDSN"`
+	GroupSize      int           `yaml:"groupSize"`
+	MinGroupSize   int           `yaml:"minGroupSize"`
+	MaxGroupSize   int           `yaml:"maxGroupSize"`
+	Seed           int64         `yaml:"seed"`
+	Strategy       string        `yaml:"strategy"`
+	Iterations     int           `yaml:"iterations"`
+	TimeBudget     time.Duration `yaml:"timeBudget"`
+	HalfLife       time.Duration `yaml:"halfLife"`
+	CooldownRounds int           `yaml:"cooldownRounds"`
+	UserCacheTTL   time.Duration `yaml:"userCacheTTL"`
+	SlackTimeout   time.Duration `yaml:"slackTimeout"`
+	// Announcement is blocks, the default, or text. AnnouncementContext is
+	// an optional line like the meeting link or an icebreaker.
+	Announcement        string `yaml:"announcement"`
+	AnnouncementContext string `yaml:"announcementContext"`
+	// Program keys the history of the config in the database, so several
+	// programs can share one database.
+	Program          string          `yaml:"program"`
+	ShareHistoryWith string          `yaml:"shareHistoryWith"`
+	Programs         []ProgramConfig `yaml:"programs"`
+}
+
+// ProgramConfig is one of the programs sharing the database of a config,
+// like a weekly coffee and a monthly lunch. Settings it leaves unset are
+// taken from the config. A program sharing the history of another program
+// avoids pairs met in either of them.
+type ProgramConfig struct {
+	Key              string        `yaml:"key"`
+	SlackChannel     string        `yaml:"slackChannel"`
+	GroupSize        int           `yaml:"groupSize"`
+	MinGroupSize     int           `yaml:"minGroupSize"`
+	MaxGroupSize     int           `yaml:"maxGroupSize"`
+	Strategy         string        `yaml:"strategy"`
+	HalfLife         time.Duration `yaml:"halfLife"`
+	CooldownRounds   int           `yaml:"cooldownRounds"`
+	ShareHistoryWith string        `yaml:"shareHistoryWith"`
 }
 
 var slackApi *slack.Client
 
+const (
+	RUN_REPLAY = "replay"
+	RUN_FORCE  = "force"
+	// RUN_LOCK_TTL is how long the run lock of a crashed run holds.
+	RUN_LOCK_TTL = time.Hour
+	// USER_CACHE_TTL is how long Slack users are cached by default.
+	USER_CACHE_TTL = 24 * time.Hour
+	// SLACK_TIMEOUT is how long a command waits for Slack by default,
+	// rate limits included.
+	SLACK_TIMEOUT = 5 * time.Minute
+)
+
+const usage = `Error! Usage: coffeetable [-program <key>] <conf-file-path> [replay|force]
+       coffeetable [-program <key>] plan <conf-file-path> <rounds>
+       coffeetable [-program <key>] constraint <conf-file-path> list
+       coffeetable [-program <key>] constraint <conf-file-path> add apart|together <user1> <user2>
+       coffeetable [-program <key>] constraint <conf-file-path> add pin <user> <group>
+       coffeetable [-program <key>] constraint <conf-file-path> remove <id>
+       coffeetable [-program <key>] history <conf-file-path>
+       coffeetable [-program <key>] rollback <conf-file-path> [<round-id>] [delete-message]
+       coffeetable migrate <conf-file-path>
+       coffeetable [-program <key>] export <conf-file-path> relations|rounds csv|json [<file>]
+       coffeetable [-program <key>] import <conf-file-path> relations|rounds csv|json <file> [dry-run] [allow-unknown]
+
+Without -program every configured program is run, other commands need it
+when more than one program is configured. A program runs once a day: replay
+publishes the groups of the day if they are not published yet, force deletes
+their announcement, rolls them back and makes new ones. Import resolves user
+names to the IDs of channel members and refuses users it cannot resolve,
+unless allow-unknown keeps them as they are.`
+
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Error! Usage: coffeetable <conf-file-path>")
-		os.Exit(1)
+	args := os.Args[1:]
+	program := ""
+	if len(args) >= 2 && args[0] == "-program" {
+		program, args = args[1], args[2:]
 	}
-	conf, err := readConfig(os.Args[1])
-	if err != nil {
-		fmt.Println("Error while reading conf file:", err)
-		os.Exit(1)
+	if len(args) < 1 {
+		exitWithUsage()
+	}
+	switch args[0] {
+	case "plan":
+		if len(args) < 3 {
+			exitWithUsage()
+		}
+		rounds, err := strconv.Atoi(args[2])
+		if err != nil {
+			fmt.Println("Error! Rounds should be a number:", err)
+			os.Exit(1)
+		}
+		plan(mustReadProgram(args[1], program), rounds)
+	case "migrate":
+		if len(args) < 2 {
+			exitWithUsage()
+		}
+		_, closeRepo, err := openRepo(mustReadConfig(args[1]))
+		panicOnErr(err)
+		closeRepo()
+	case "export":
+		if len(args) < 2 {
+			exitWithUsage()
+		}
+		export(mustReadProgram(args[1], program), args[2:])
+	case "import":
+		if len(args) < 2 {
+			exitWithUsage()
+		}
+		importHistory(mustReadProgram(args[1], program), args[2:])
+	case "history":
+		if len(args) < 2 {
+			exitWithUsage()
+		}
+		listRounds(mustReadProgram(args[1], program))
+	case "rollback":
+		if len(args) < 2 {
+			exitWithUsage()
+		}
+		if !rollback(mustReadProgram(args[1], program), args[2:]) {
+			os.Exit(1)
+		}
+	case "constraint":
+		if len(args) < 3 {
+			exitWithUsage()
+		}
+		constraint(mustReadProgram(args[1], program), args[2:])
+	default:
+		mode := ""
+		if len(args) > 1 {
+			mode = args[1]
+		}
+		if len(args) > 2 || (mode != "" && mode != RUN_REPLAY && mode != RUN_FORCE) {
+			exitWithUsage()
+		}
+		programs, err := mustReadConfig(args[0]).programs(program)
+		exitOnConfigErr(err)
+		failed := false
+		for _, conf := range programs {
+			if len(programs) > 1 {
+				fmt.Println("Program:", conf.Program)
+			}
+			if !run(conf, mode) {
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	}
+}
+
+// run makes and publishes the round of the day of a program while holding
+// its run lock. It refuses, reporting false, when another run holds the lock
+// or the round of the day is already made and mode is neither replay nor
+// force. Force deletes the announcement of the round before making it again,
+// and refuses when it cannot.
+func run(conf *ServerConfig, mode string) bool {
+	repo, closeRepo, err := openRepo(conf)
+	panicOnErr(err)
+	defer closeRepo()
+	scope := conf.scope()
+	unlock, locked := lockRun(repo, scope)
+	if !locked {
+		return false
 	}
-	db, err := sql.Open("sqlite3", conf.DatabasePath)
+	defer unlock()
+	slackService := conf.slackService(repo)
+	ctx, cancel := conf.slackContext()
+	defer cancel()
+	opts := conf.groupOptions()
+	key := ct.RunKey(opts.Now)
+	rounds, err := repo.GetRounds(scope)
 	panicOnErr(err)
-	defer db.Close()
-	slackService := slackhelper.New(conf.SlackToken, conf.SlackChannel, conf.PrivateChannel)
-	members, err := slackService.GetChannelMembers()
+	for _, done := range rounds {
+		if done.Key != key || done.Reverted {
+			continue
+		}
+		switch mode {
+		case RUN_REPLAY:
+			replay(ctx, repo, scope, slackService, conf.announcement(), done)
+			return true
+		case RUN_FORCE:
+			if done.MessageTS != "" {
+				if err = slackService.DeleteMessage(ctx, done.MessageTS); err != nil {
+					fmt.Printf("Error! Cannot delete the Slack message of round %d to make it again: %v\n", done.ID, err)
+					return false
+				}
+				fmt.Printf("Deleted the Slack message of round %d.\n", done.ID)
+			}
+			reverted, err := repo.RevertRound(scope, done.ID)
+			panicOnErr(err)
+			fmt.Printf("Rolled back round %d of %s to make it again.\n", done.ID, key)
+			if reverted.Schedule != nil {
+				fmt.Println("Rewound the round robin schedule.")
+			}
+		default:
+			fmt.Printf("Error! Round %d of %s is already made, run with replay to publish it or force to make it again.\n", done.ID, key)
+			return false
+		}
+	}
+	members, err := slackService.GetChannelMembers(ctx)
 	panicOnErr(err)
 	fmt.Println("Channel member count:", len(members))
 	printMembers(members)
-	repo := repo.New(db)
-	relations, err := repo.GetUserRelations()
+	migrateToUserIDs(repo, scope, members)
+	relations, err := repo.GetUserRelations(scope)
+	panicOnErr(err)
+	opts.Constraints, err = repo.GetConstraints(scope)
+	panicOnErr(err)
+	opts.Encounters, err = loadEncounters(repo, scope, opts)
+	panicOnErr(err)
+	fmt.Println("Seed:", opts.Seed)
+	grouper, err := ct.NewGrouper(conf.Strategy, opts)
 	panicOnErr(err)
-	groups, relations, err := ct.GenerateGroups(relations, members)
+	roundRobin, isRoundRobin := grouper.(*ct.RoundRobinGrouper)
+	if isRoundRobin {
+		schedule, err := repo.GetSchedule(scope)
+		panicOnErr(err)
+		fmt.Println("Round robin round:", schedule.Round)
+		roundRobin.Schedule = &schedule
+	}
+	groups, _, err := grouper.Group(relations, members)
+	panicOnErr(err)
+	if isRoundRobin && roundRobin.Schedule.NewCycle {
+		fmt.Println("Round robin cycle started over, joiners found no free seat.")
+	}
+	if cooldownGrouper, ok := grouper.(ct.CooldownGrouper); ok {
+		printCooldown(opts, cooldownGrouper.Cooldown())
+	}
 	printGroups(groups)
+	fmt.Println("Repeat encounters:", ct.TotalEncounters(groups, relations))
+	strategy := conf.Strategy
+	if strategy == "" {
+		strategy = ct.STRATEGY_WEIGHTED
+	}
+	round := ct.NewRound(opts.Now, conf.SlackChannel, strategy, opts.Seed, groups)
+	round.Key = key
+	if isRoundRobin {
+		round.Schedule = roundRobin.Schedule
+	}
+	err = repo.SaveRound(scope, &round)
+	panicOnErr(err)
+	ts, err := slackService.PublishGroupsInSlack(ctx, groups, conf.announcement())
+	panicOnErr(err)
+	err = repo.SetRoundMessage(scope, round.ID, ts)
+	panicOnErr(err)
+	return true
+}
+
+// replay publishes a round made by an earlier run, unless it is published.
+// Users are taken from the user cache for their names and avatars.
+func replay(ctx context.Context, r repo.Repo, scope repo.Scope, slackService slackhelper.SlackHelper, announcement slackhelper.Announcement, round ct.Round) {
+	cached, _, err := r.GetUserCache()
 	panicOnErr(err)
-	for _, r := range relations {
-		err := repo.UpdateEncounters(r)
+	users := make(map[string]ct.User)
+	for _, u := range cached {
+		users[u.ID] = u
+	}
+	groups := make([][]ct.User, len(round.Groups))
+	for i, g := range round.Groups {
+		for _, id := range g {
+			u, ok := users[id]
+			if !ok {
+				u = ct.User{ID: id}
+			}
+			groups[i] = append(groups[i], u)
+		}
+	}
+	printGroups(groups)
+	if round.MessageTS != "" {
+		fmt.Printf("Round %d is already published.\n", round.ID)
+		return
+	}
+	ts, err := slackService.PublishGroupsInSlack(ctx, groups, announcement)
+	panicOnErr(err)
+	err = r.SetRoundMessage(scope, round.ID, ts)
+	panicOnErr(err)
+	fmt.Printf("Published round %d.\n", round.ID)
+}
+
+// lockRun takes the run lock of the program and returns the func releasing
+// it. It reports false when another run holds the lock.
+func lockRun(r repo.Repo, scope repo.Scope) (func(), bool) {
+	owner := runLockOwner()
+	acquired, err := r.AcquireRunLock(scope, owner, time.Now(), RUN_LOCK_TTL)
+	panicOnErr(err)
+	if !acquired {
+		fmt.Println("Error! Another run of the program holds the run lock.")
+		return nil, false
+	}
+	return func() {
+		panicOnErr(r.ReleaseRunLock(scope, owner))
+	}, true
+}
+
+// runLockOwner names this process in run locks.
+func runLockOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+func plan(conf *ServerConfig, rounds int) {
+	repo, closeRepo, err := openRepo(conf)
+	panicOnErr(err)
+	defer closeRepo()
+	ctx, cancel := conf.slackContext()
+	defer cancel()
+	members, err := conf.slackService(repo).GetChannelMembers(ctx)
+	panicOnErr(err)
+	scope := conf.scope()
+	migrateToUserIDs(repo, scope, members)
+	relations, err := repo.GetUserRelations(scope)
+	panicOnErr(err)
+	opts := conf.groupOptions()
+	opts.Constraints, err = repo.GetConstraints(scope)
+	panicOnErr(err)
+	opts.Encounters, err = loadEncounters(repo, scope, opts)
+	panicOnErr(err)
+	schedule := ct.CircleSchedule{}
+	if conf.Strategy == ct.STRATEGY_ROUNDROBIN {
+		schedule, err = repo.GetSchedule(scope)
 		panicOnErr(err)
 	}
-	err = slackService.PublishGroupsInSlack(groups)
+	planned, err := ct.PlanRounds(relations, members, rounds, conf.Strategy, schedule, opts)
 	panicOnErr(err)
+	for i, round := range planned {
+		fmt.Printf("Round %d %s (seed %d):\n", i+1, round.Date.Format("2006-01-02"), round.Seed)
+		printCooldown(opts, round.Cooldown)
+		printGroups(round.Groups)
+		fmt.Println("Repeat encounters:", ct.TotalEncounters(round.Groups, relations))
+		relations = round.Relations
+	}
+}
+func exitWithUsage() {
+	fmt.Println(usage)
+	os.Exit(1)
+}
+func mustReadConfig(filePath string) *ServerConfig {
+	conf, err := readConfig(filePath)
+	if err != nil {
+		fmt.Println("Error while reading conf file:", err)
+		os.Exit(1)
+	}
+	return conf
+}
 
+// mustReadProgram reads the config of the program with the given key, or
+// of the only program when key is empty.
+func mustReadProgram(filePath string, key string) *ServerConfig {
+	programs, err := mustReadConfig(filePath).programs(key)
+	exitOnConfigErr(err)
+	if len(programs) > 1 {
+		fmt.Println("Error! Several programs are configured, pick one with -program")
+		os.Exit(1)
+	}
+	return programs[0]
+}
+func exitOnConfigErr(err error) {
+	if err != nil {
+		fmt.Println("Error while reading conf file:", err)
+		os.Exit(1)
+	}
 }
 func readConfig(filePath string) (conf *ServerConfig, err error) {
 	confContent, err := ioutil.ReadFile(filePath)
@@ -68,17 +400,231 @@ func readConfig(filePath string) (conf *ServerConfig, err error) {
 	}
 	return
 }
+
+// programs returns a config for each configured program, or for the one
+// with the given key. A config without programs is a single program.
+func (conf *ServerConfig) programs(key string) ([]*ServerConfig, error) {
+	if len(conf.Programs) == 0 {
+		if key != "" && key != conf.Program {
+			return nil, fmt.Errorf("Unknown program: %s", key)
+		}
+		return []*ServerConfig{conf}, nil
+	}
+	programs := []*ServerConfig{}
+	seen := make(map[string]bool)
+	for _, p := range conf.Programs {
+		if p.Key == "" {
+			return nil, errors.New("Every program should have a key!")
+		}
+		if seen[p.Key] {
+			return nil, fmt.Errorf("Program %s is configured more than once!", p.Key)
+		}
+		seen[p.Key] = true
+		if key == "" || key == p.Key {
+			programs = append(programs, conf.forProgram(p))
+		}
+	}
+	if len(programs) == 0 {
+		return nil, fmt.Errorf("Unknown program: %s", key)
+	}
+	return programs, nil
+}
+func (conf *ServerConfig) forProgram(p ProgramConfig) *ServerConfig {
+	c := *conf
+	c.Programs = nil
+	c.Program = p.Key
+	c.ShareHistoryWith = p.ShareHistoryWith
+	if p.SlackChannel != "" {
+		c.SlackChannel = p.SlackChannel
+	}
+	if p.GroupSize > 0 {
+		c.GroupSize = p.GroupSize
+	}
+	if p.MinGroupSize > 0 {
+		c.MinGroupSize = p.MinGroupSize
+	}
+	if p.MaxGroupSize > 0 {
+		c.MaxGroupSize = p.MaxGroupSize
+	}
+	if p.Strategy != "" {
+		c.Strategy = p.Strategy
+	}
+	if p.HalfLife > 0 {
+		c.HalfLife = p.HalfLife
+	}
+	if p.CooldownRounds > 0 {
+		c.CooldownRounds = p.CooldownRounds
+	}
+	return &c
+}
+
+// slackService returns the Slack helper of the config, caching users in r.
+func (conf *ServerConfig) slackService(r repo.Repo) slackhelper.SlackHelper {
+	ttl := conf.UserCacheTTL
+	if ttl == 0 {
+		ttl = USER_CACHE_TTL
+	}
+	return slackhelper.NewWithCache(conf.SlackToken, conf.SlackChannel, r, ttl)
+}
+
+// announcement returns how the config announces groups.
+func (conf *ServerConfig) announcement() slackhelper.Announcement {
+	return slackhelper.Announcement{Format: conf.Announcement, Context: conf.AnnouncementContext}
+}
+
+// slackContext returns the context of the Slack calls of a command.
+func (conf *ServerConfig) slackContext() (context.Context, context.CancelFunc) {
+	timeout := conf.SlackTimeout
+	if timeout == 0 {
+		timeout = SLACK_TIMEOUT
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// scope is where the program of the config keeps its data in the repo.
+func (conf *ServerConfig) scope() repo.Scope {
+	history := conf.ShareHistoryWith
+	if history == "" {
+		history = conf.Program
+	}
+	return repo.Scope{Program: conf.Program, History: history}
+}
+
+// groupOptions returns the grouping options of the config. Unless
+// minGroupSize and maxGroupSize say otherwise, groupSize keeps groups at
+// least 2 members big, so nobody has coffee alone, and lets a group take one
+// more member for an awkward remainder.
+func (conf *ServerConfig) groupOptions() ct.Options {
+	opts := ct.DefaultOptions()
+	if conf.GroupSize > 0 {
+		opts.GroupSize = conf.GroupSize
+		opts.MinGroupSize = 2
+		if conf.GroupSize < 2 {
+			opts.MinGroupSize = conf.GroupSize
+		}
+		opts.MaxGroupSize = conf.GroupSize + 1
+	}
+	if conf.MinGroupSize > 0 {
+		opts.MinGroupSize = conf.MinGroupSize
+	}
+	if conf.MaxGroupSize > 0 {
+		opts.MaxGroupSize = conf.MaxGroupSize
+	}
+	if conf.Seed != 0 {
+		opts.Seed = conf.Seed
+	}
+	if conf.Iterations > 0 {
+		opts.Iterations = conf.Iterations
+	}
+	opts.TimeBudget = conf.TimeBudget
+	opts.HalfLife = conf.HalfLife
+	opts.CooldownRounds = conf.CooldownRounds
+	opts.Now = time.Now()
+	return opts
+}
+
+// openRepo opens the configured repo and returns it with a function
+// closing it. SQL databases are migrated to the latest schema first. SQLite
+// is the default driver, its DSN defaults to the database path as does the
+// file of the json driver.
+func openRepo(conf *ServerConfig) (repo.Repo, func() error, error) {
+	driver := conf.DatabaseDriver
+	if driver == "" {
+		driver = repo.DRIVER_SQLITE
+	}
+	dsn := conf.DatabaseDSN
+	if dsn == "" {
+		dsn = conf.DatabasePath
+	}
+	noop := func() error { return nil }
+	switch driver {
+	case repo.DRIVER_MEMORY:
+		return repo.NewMemory(), noop, nil
+	case repo.DRIVER_JSON:
+		r, err := repo.NewJSONFile(dsn)
+		return r, noop, err
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := repo.NewWithDriver(driver, db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	applied, err := repo.Migrate(db, driver)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	for _, name := range applied {
+		fmt.Println("Applied migration:", name)
+	}
+	return r, db.Close, nil
+}
+func listRounds(conf *ServerConfig) {
+	repo, closeRepo, err := openRepo(conf)
+	panicOnErr(err)
+	defer closeRepo()
+	rounds, err := repo.GetRounds(conf.scope())
+	panicOnErr(err)
+	for _, round := range rounds {
+		reverted := ""
+		if round.Reverted {
+			reverted = " rolled back"
+		}
+		fmt.Printf("Round %d %s #%s %s (seed %d)%s:\n", round.ID, round.Date.Format(time.RFC3339), round.Channel, round.Strategy, round.Seed, reverted)
+		for i, g := range round.Groups {
+			fmt.Printf("  Group %d: %s\n", i+1, strings.Join(g, ", "))
+		}
+	}
+}
+
+// migrateToUserIDs moves the history of scope stored by user name to user
+// IDs, using the current channel members to map the names.
+func migrateToUserIDs(r repo.Repo, scope repo.Scope, members []ct.User) {
+	migrated, err := r.MigrateToUserIDs(scope, members)
+	panicOnErr(err)
+	if migrated {
+		fmt.Println("Migrated history from user names to user IDs.")
+	}
+}
+
+// loadEncounters loads the dated encounters the options need: all of them
+// for decay, the last rounds for the cooldown, none otherwise.
+func loadEncounters(r repo.Repo, scope repo.Scope, opts ct.Options) ([]ct.Encounter, error) {
+	if opts.HalfLife > 0 {
+		return r.GetEncounters(scope)
+	}
+	if opts.CooldownRounds > 0 {
+		return r.GetRecentEncounters(scope, opts.CooldownRounds)
+	}
+	return nil, nil
+}
 func panicOnErr(err error) {
 	if err != nil {
 		panic(err)
 	}
 }
+
+// printCooldown reports a cooldown relaxed to fit the roster.
+func printCooldown(opts ct.Options, cooldown int) {
+	if cooldown < opts.CooldownRounds {
+		fmt.Printf("Cooldown relaxed from %d to %d rounds, the roster is too small.\n", opts.CooldownRounds, cooldown)
+	}
+}
 func printMembers(members []ct.User) {
 	for _, u := range members {
 		fmt.Printf("%s %15s\n", u.ID, u.Name)
 	}
 }
 func printGroups(groups [][]ct.User) {
+	groupSizes := make([]int, len(groups))
+	for i, g := range groups {
+		groupSizes[i] = len(g)
+	}
+	fmt.Println("Group Sizes:", groupSizes)
 	fmt.Println("Groups I have found:")
 	for i, g := range groups {
 		fmt.Printf("Group %d:\n", i)
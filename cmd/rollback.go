@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mtyurt/coffeetable/slackhelper"
+)
+
+// rollback reverts the round with the ID in args, or the latest round, and
+// deletes its Slack announcement when asked to. It holds the run lock so a
+// run cannot make a round meanwhile, and reports false when it fails.
+func rollback(conf *ServerConfig, args []string) bool {
+	deleteMessage := len(args) > 0 && args[len(args)-1] == "delete-message"
+	if deleteMessage {
+		args = args[:len(args)-1]
+	}
+	if len(args) > 1 {
+		exitWithUsage()
+	}
+	repo, closeRepo, err := openRepo(conf)
+	panicOnErr(err)
+	defer closeRepo()
+	scope := conf.scope()
+	id := 0
+	if len(args) == 1 {
+		if id, err = strconv.Atoi(args[0]); err != nil {
+			fmt.Println("Error! Round id should be a number:", err)
+			exitWithUsage()
+		}
+	}
+	unlock, locked := lockRun(repo, scope)
+	if !locked {
+		return false
+	}
+	defer unlock()
+	if id == 0 {
+		rounds, err := repo.GetRounds(scope)
+		panicOnErr(err)
+		for _, round := range rounds {
+			if !round.Reverted {
+				id = round.ID
+				break
+			}
+		}
+		if id == 0 {
+			fmt.Println("Error! There is no round to roll back.")
+			return false
+		}
+	}
+	round, err := repo.RevertRound(scope, id)
+	if err != nil {
+		fmt.Println("Error!", err)
+		return false
+	}
+	fmt.Printf("Rolled back round %d %s #%s.\n", round.ID, round.Date.Format(time.RFC3339), round.Channel)
+	if round.Schedule != nil {
+		fmt.Println("Rewound the round robin schedule.")
+	}
+	if !deleteMessage {
+		return true
+	}
+	if round.MessageTS == "" {
+		fmt.Println("Round has no Slack message to delete.")
+		return true
+	}
+	ctx, cancel := conf.slackContext()
+	defer cancel()
+	err = slackhelper.New(conf.SlackToken, round.Channel).DeleteMessage(ctx, round.MessageTS)
+	panicOnErr(err)
+	fmt.Println("Deleted the Slack message of the round.")
+	return true
+}
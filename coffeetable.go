@@ -4,12 +4,17 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"sort"
+	"time"
 
 	"github.com/jmcvetta/randutil"
 	"github.com/nlopes/slack"
 )
 
 type User slack.User
+
+// UserRelation counts the encounters of two users, keyed by their Slack user
+// IDs so that history survives renames.
 type UserRelation struct {
 	ID         int
 	User1      string
@@ -18,42 +23,130 @@ type UserRelation struct {
 }
 
 func GenerateGroups(relations []UserRelation, users []User) ([][]User, []UserRelation, error) {
-	users = shuffleUsers(users)
-	groupSizes := generateGroupSizes(len(users))
-	fmt.Println("Group Sizes:", groupSizes)
+	return GenerateGroupsWithOptions(relations, users, DefaultOptions())
+}
+
+func GenerateGroupsWithOptions(relations []UserRelation, users []User, opts Options) ([][]User, []UserRelation, error) {
+	groups, relations, _, err := generateGroupsWithOptions(relations, users, opts)
+	return groups, relations, err
+}
+
+// generateGroupsWithOptions is GenerateGroupsWithOptions also returning the
+// rounds of cooldown the groups respect, see withCooldown.
+func generateGroupsWithOptions(relations []UserRelation, users []User, opts Options) ([][]User, []UserRelation, int, error) {
+	groupSizes, err := generateGroupSizesWithOptions(len(users), opts)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	encounters := weightedEncounterMap(relations, opts)
+	groups, cooldown, err := withCooldown(opts, func(constraints constraintSet) ([][]User, error) {
+		rnd := rand.New(rand.NewSource(opts.Seed))
+		return generateGroups(rnd, sortUsers(users), groupSizes, encounters, constraints)
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return groups, recordGroups(relations, groups), cooldown, nil
+}
+
+// generateGroups starts over with a new shuffle when the constraints leave a
+// group without any possible member.
+func generateGroups(rnd *rand.Rand, users []User, groupSizes []int, encounters map[string]int, constraints constraintSet) ([][]User, error) {
+	p, err := constraints.place(users, groupSizes)
+	if err != nil {
+		return nil, err
+	}
+	for attempt := 0; attempt < MAX_CONSTRAINT_ATTEMPTS; attempt++ {
+		groups, err := tryGenerateGroups(rnd, shuffleUsers(rnd, users), groupSizes, encounters, p)
+		if err != errNoCandidate {
+			return groups, err
+		}
+	}
+	return nil, ErrConstraintsUnsatisfiable
+}
+func tryGenerateGroups(rnd *rand.Rand, users []User, groupSizes []int, encounters map[string]int, p placement) ([][]User, error) {
 	groups := make([][]User, len(groupSizes))
+	for i := range groups {
+		users = deleteGroupFromUsers(users, p.pinned[i])
+	}
 	for i, s := range groupSizes {
-		groups[i] = make([]User, s)
-		baseUser := users[0]
-		wc := calculateWeightedChoices(baseUser, users[1:], relations)
-		chosenNames, err := calculateRandomizedGroup(wc, s-1)
-		if err != nil {
-			return nil, nil, err
+		group := append([]User{}, p.pinned[i]...)
+		if len(group) == 0 {
+			base := p.allowedCandidates(group, users, s)
+			if len(base) == 0 {
+				return nil, errNoCandidate
+			}
+			group = p.clusterOf(base[0])
 		}
-		chosenUsers, err := convertNamesToUsers(users, chosenNames)
+		group, err := buildGroup(rnd, group, deleteGroupFromUsers(users, group), encounters, p, s)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
-		groups[i] = append(chosenUsers, baseUser)
-		relations = updateRelationsWithNewGroup(relations, groups[i])
+		groups[i] = group
 		users = deleteGroupFromUsers(users, groups[i])
 	}
-	return groups, relations, nil
+	return groups, nil
 }
-func calculateWeightedChoices(baseUser User, users []User, relations []UserRelation) []randutil.Choice {
-	choices := make([]randutil.Choice, len(users))
+
+// buildGroup picks members one by one, weighting every candidate by its
+// encounters with all of the members chosen so far. Choosing a candidate
+// brings its whole cluster into the group.
+func buildGroup(rnd *rand.Rand, group []User, candidates []User, encounters map[string]int, p placement, size int) ([]User, error) {
+	for len(group) < size {
+		allowed := p.allowedCandidates(group, candidates, size-len(group))
+		if len(allowed) == 0 {
+			return nil, errNoCandidate
+		}
+		wc := calculateWeightedChoices(group, allowed, encounters, p.clusters)
+		chosenIDs, err := calculateRandomizedGroup(rnd, wc, 1)
+		if err != nil {
+			return nil, err
+		}
+		chosenUsers, err := convertIDsToUsers(candidates, chosenIDs)
+		if err != nil {
+			return nil, err
+		}
+		chosenUsers = p.clusterOf(chosenUsers[0])
+		group = append(chosenUsers, group...)
+		candidates = deleteGroupFromUsers(candidates, chosenUsers)
+	}
+	return group, nil
+}
+func encounterMap(relations []UserRelation) map[string]int {
 	relMap := make(map[string]int)
 	for _, r := range relations {
 		relMap[r.User1+"|"+r.User2] = r.Encounters
 		relMap[r.User2+"|"+r.User1] = r.Encounters
 	}
+	return relMap
+}
+func groupEncounters(group []User, encounters map[string]int) int {
+	total := 0
+	for i := 0; i < len(group)-1; i++ {
+		for j := i + 1; j < len(group); j++ {
+			total += encounters[group[i].ID+"|"+group[j].ID]
+		}
+	}
+	return total
+}
+
+// calculateWeightedChoices scores users present in clusters with the
+// encounters of their whole cluster.
+func calculateWeightedChoices(group []User, users []User, encounters map[string]int, clusters map[string][]User) []randutil.Choice {
+	choices := make([]randutil.Choice, len(users))
 	maxEncounter := 0
 	for i, u := range users {
-		e, ok := relMap[u.Name+"|"+baseUser.Name]
+		cluster, ok := clusters[u.ID]
 		if !ok {
-			e = 0
+			cluster = []User{u}
+		}
+		e := 0
+		for _, c := range cluster {
+			for _, member := range group {
+				e += encounters[c.ID+"|"+member.ID]
+			}
 		}
-		choices[i] = randutil.Choice{e, u.Name}
+		choices[i] = randutil.Choice{e, u.ID}
 		if e > maxEncounter {
 			maxEncounter = e
 		}
@@ -64,10 +157,10 @@ func calculateWeightedChoices(baseUser User, users []User, relations []UserRelat
 	}
 	return choices
 }
-func calculateRandomizedGroup(weightedChoices []randutil.Choice, size int) ([]string, error) {
+func calculateRandomizedGroup(rnd *rand.Rand, weightedChoices []randutil.Choice, size int) ([]string, error) {
 	names := make([]string, size)
 	for i := 0; i < size; i++ {
-		choice, err := randutil.WeightedChoice(weightedChoices)
+		choice, err := weightedChoice(rnd, weightedChoices)
 		if err != nil {
 			return nil, err
 		}
@@ -81,6 +174,23 @@ func calculateRandomizedGroup(weightedChoices []randutil.Choice, size int) ([]st
 	}
 	return names, nil
 }
+func weightedChoice(rnd *rand.Rand, choices []randutil.Choice) (randutil.Choice, error) {
+	sum := 0
+	for _, c := range choices {
+		sum += c.Weight
+	}
+	if sum <= 0 {
+		return randutil.Choice{}, errors.New("Cannot choose from choices without positive weight!")
+	}
+	r := rnd.Intn(sum)
+	for _, c := range choices {
+		r -= c.Weight
+		if r < 0 {
+			return c, nil
+		}
+	}
+	return randutil.Choice{}, errors.New("Weighted choice could not be made!")
+}
 func removeChoice(choices []randutil.Choice, tbd randutil.Choice) []randutil.Choice {
 	for i, c := range choices {
 		if c.Item == tbd.Item {
@@ -89,16 +199,16 @@ func removeChoice(choices []randutil.Choice, tbd randutil.Choice) []randutil.Cho
 	}
 	return choices
 }
-func convertNamesToUsers(users []User, names []string) ([]User, error) {
+func convertIDsToUsers(users []User, ids []string) ([]User, error) {
 	userMap := make(map[string]User)
 	for _, u := range users {
-		userMap[u.Name] = u
+		userMap[u.ID] = u
 	}
-	subgroup := make([]User, len(names))
-	for i, n := range names {
-		u, ok := userMap[n]
+	subgroup := make([]User, len(ids))
+	for i, id := range ids {
+		u, ok := userMap[id]
 		if !ok {
-			return nil, errors.New(fmt.Sprintf("Error! The user list does not have a user with name [%s]!", n))
+			return nil, errors.New(fmt.Sprintf("Error! The user list does not have a user with id [%s]!", id))
 		}
 		subgroup[i] = u
 	}
@@ -106,13 +216,12 @@ func convertNamesToUsers(users []User, names []string) ([]User, error) {
 }
 func updateRelationsWithNewGroup(relations []UserRelation, group []User) []UserRelation {
 	relMap := make(map[string]UserRelation)
-	remainingRelations := make(map[string]UserRelation)
+	updatedRelations := make(map[string]bool)
 	for _, r := range relations {
 		er, ok := relMap[r.User1+"|"+r.User2]
 		if ok {
 			panic(fmt.Sprintf("Relation already exists: %v\n", er))
 		}
-		remainingRelations[r.User1+"|"+r.User2] = r
 		relMap[r.User1+"|"+r.User2] = r
 		relMap[r.User2+"|"+r.User1] = r
 	}
@@ -122,18 +231,20 @@ func updateRelationsWithNewGroup(relations []UserRelation, group []User) []UserR
 		for j := i + 1; j < groupSize; j++ {
 			u1 := group[i]
 			u2 := group[j]
-			rel, ok := relMap[u1.Name+"|"+u2.Name]
+			rel, ok := relMap[u1.ID+"|"+u2.ID]
 			if !ok {
-				rel = UserRelation{User1: u1.Name, User2: u2.Name, Encounters: 0}
+				rel = UserRelation{User1: u1.ID, User2: u2.ID, Encounters: 0}
 			} else {
-				delete(remainingRelations, rel.User1+"|"+rel.User2)
+				updatedRelations[rel.User1+"|"+rel.User2] = true
 			}
 			rel.Encounters++
 			newRels = append(newRels, rel)
 		}
 	}
-	for _, rel := range remainingRelations {
-		newRels = append(newRels, rel)
+	for _, rel := range relations {
+		if !updatedRelations[rel.User1+"|"+rel.User2] {
+			newRels = append(newRels, rel)
+		}
 	}
 	return newRels
 }
@@ -145,7 +256,7 @@ func deleteGroupFromUsers(from []User, tbd []User) []User {
 	for _, t := range tbd {
 	inner:
 		for i, f := range users {
-			if f.Name == t.Name {
+			if f.ID == t.ID {
 				users = append(users[:i], users[i+1:]...)[:len(users)-1]
 				break inner
 			}
@@ -157,40 +268,109 @@ func deleteGroupFromUsers(from []User, tbd []User) []User {
 
 const NORMAL_GROUP_SIZE = 4
 
-func generateGroupSizes(size int) []int {
-	if size <= NORMAL_GROUP_SIZE {
-		return []int{size}
+// Options controls how GenerateGroupsWithOptions splits users into groups.
+// GroupSize is the preferred size, MinGroupSize and MaxGroupSize are the
+// hard bounds every generated group has to respect. The same users,
+// relations and Seed always produce the same groups. Iterations and
+// TimeBudget only limit OptimizeGroups. Constraints are never violated.
+// With a positive HalfLife, Encounters older than Now weigh less. Pairs who
+// met in the last CooldownRounds rounds of Encounters are kept apart, unless
+// the roster is too small for that.
+type Options struct {
+	GroupSize      int
+	MinGroupSize   int
+	MaxGroupSize   int
+	Seed           int64
+	Iterations     int
+	TimeBudget     time.Duration
+	Constraints    []Constraint
+	HalfLife       time.Duration
+	Encounters     []Encounter
+	Now            time.Time
+	CooldownRounds int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		GroupSize:    NORMAL_GROUP_SIZE,
+		MinGroupSize: 1,
+		MaxGroupSize: NORMAL_GROUP_SIZE,
+		Seed:         NewSeed(),
+		Iterations:   DEFAULT_ITERATIONS,
+	}
+}
+
+func NewSeed() int64 {
+	return time.Now().UnixNano()
+}
+
+func (o Options) validate() error {
+	if o.GroupSize < 1 {
+		return fmt.Errorf("Group size must be positive, it was: %d", o.GroupSize)
+	}
+	if o.MinGroupSize < 1 || o.MinGroupSize > o.GroupSize {
+		return fmt.Errorf("Min group size must be between 1 and group size %d, it was: %d", o.GroupSize, o.MinGroupSize)
+	}
+	if o.MaxGroupSize < o.GroupSize {
+		return fmt.Errorf("Max group size must be at least group size %d, it was: %d", o.GroupSize, o.MaxGroupSize)
 	}
-	remaining := size
-	groupSizes := make([]int, remaining/NORMAL_GROUP_SIZE+1)
-	i := 0
-	for remaining >= NORMAL_GROUP_SIZE {
-		groupSizes[i] = NORMAL_GROUP_SIZE
-		i++
-		remaining = remaining - NORMAL_GROUP_SIZE
+	return nil
+}
+
+// generateGroupSizesWithOptions starts with as many groups as needed to keep
+// every group at most GroupSize, then merges groups while the smallest one
+// would be under MinGroupSize. Members are spread evenly, bigger groups first.
+func generateGroupSizesWithOptions(size int, opts Options) ([]int, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
 	}
-	if remaining == 0 {
-		return groupSizes[:i]
+	if size == 0 {
+		return []int{}, nil
 	}
-	groupSizes[i] = remaining
-	if i < 2 {
-		groupSizes[0] = size - size/2
-		groupSizes[1] = size / 2
-	} else {
-		j := i - 1
-		for groupSizes[i] != NORMAL_GROUP_SIZE-1 && j >= 0 {
-			groupSizes[j] = groupSizes[j] - 1
-			groupSizes[i] = groupSizes[i] + 1
-			j--
+	for count := (size + opts.GroupSize - 1) / opts.GroupSize; count > 0; count-- {
+		smallest := size / count
+		largest := smallest
+		if size%count != 0 {
+			largest++
+		}
+		if largest > opts.MaxGroupSize {
+			break
+		}
+		if smallest < opts.MinGroupSize {
+			continue
 		}
+		groupSizes := make([]int, count)
+		for i := range groupSizes {
+			groupSizes[i] = smallest
+			if i < size%count {
+				groupSizes[i]++
+			}
+		}
+		return groupSizes, nil
+	}
+	return nil, fmt.Errorf("Cannot split %d users into groups of %d to %d members", size, opts.MinGroupSize, opts.MaxGroupSize)
+}
+
+func userNames(users []User) []string {
+	names := make([]string, len(users))
+	for i, u := range users {
+		names[i] = u.Name
 	}
+	return names
+}
 
-	return groupSizes[:i+1]
+func sortUsers(src []User) []User {
+	users := make([]User, len(src))
+	copy(users, src)
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	return users
 }
 
-func shuffleUsers(src []User) []User {
+func shuffleUsers(rnd *rand.Rand, src []User) []User {
 	dest := make([]User, len(src))
-	perm := rand.Perm(len(src))
+	perm := rnd.Perm(len(src))
 	for i, v := range perm {
 		dest[v] = src[i]
 	}
@@ -2,6 +2,8 @@ package coffeetable
 
 import (
 	"errors"
+	"math/rand"
+	"reflect"
 	"testing"
 
 	"github.com/jmcvetta/randutil"
@@ -28,6 +30,69 @@ func TestGenerateGroups(t *testing.T) {
 
 }
 
+func TestGenerateGroupsWithOptions(t *testing.T) {
+	inputUsers := []User{slackUser("tarik"), slackUser("ali"), slackUser("veli"), slackUser("deli"), slackUser("can")}
+	groups, relations, err := GenerateGroupsWithOptions([]UserRelation{}, inputUsers, sizeOptions(2, 2, 3))
+	if err != nil {
+		t.Fatal("Error is not expected:", err)
+	}
+	if len(groups) != 2 || len(groups[0]) != 3 || len(groups[1]) != 2 {
+		t.Fatalf("Groups of 3 and 2 users expected but it was: %v", groups)
+	}
+	if len(relations) != 4 {
+		t.Fatalf("Relations length is wrong, 4 relations is expected but it was %d relations: %v", len(relations), relations)
+	}
+
+	if _, _, err = GenerateGroupsWithOptions([]UserRelation{}, inputUsers, sizeOptions(2, 2, 2)); err == nil {
+		t.Fatal("Error expected when 5 users cannot be paired")
+	}
+}
+
+func TestGenerateGroupsShouldBeReproducibleWithSameSeed(t *testing.T) {
+	inputUsers := []User{slackUser("tarik"), slackUser("ali"), slackUser("veli"), slackUser("deli"), slackUser("can"), slackUser("cem"), slackUser("naz")}
+	inputRelations := []UserRelation{
+		UserRelation{User1: "tarik", User2: "ali", Encounters: 3},
+		UserRelation{User1: "deli", User2: "veli", Encounters: 1},
+		UserRelation{User1: "can", User2: "naz", Encounters: 2},
+	}
+	opts := DefaultOptions()
+	opts.Seed = 42
+
+	expectedGroups, expectedRelations, err := GenerateGroupsWithOptions(inputRelations, inputUsers, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		groups, relations, err := GenerateGroupsWithOptions(inputRelations, inputUsers, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(userGroupNames(groups), userGroupNames(expectedGroups)) {
+			t.Fatalf("Run %d, expected groups: %v but was: %v", i, userGroupNames(expectedGroups), userGroupNames(groups))
+		}
+		if !reflect.DeepEqual(relations, expectedRelations) {
+			t.Fatalf("Run %d, expected relations: %v but was: %v", i, expectedRelations, relations)
+		}
+		inputUsers = append(inputUsers[1:], inputUsers[0])
+	}
+}
+func TestWeightedChoice(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	choices := []randutil.Choice{randutil.Choice{0, "ali"}, randutil.Choice{3, "veli"}}
+	for i := 0; i < 10; i++ {
+		c, err := weightedChoice(rnd, choices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Item != "veli" {
+			t.Fatalf("Only veli has weight but %v was chosen", c.Item)
+		}
+	}
+	if _, err := weightedChoice(rnd, []randutil.Choice{randutil.Choice{0, "ali"}}); err == nil {
+		t.Fatal("Error expected when no choice has weight")
+	}
+}
+
 func TestGenerateGroupSizes(t *testing.T) {
 	testTable := map[int][]int{
 		1:  []int{1},
@@ -46,12 +111,59 @@ func TestGenerateGroupSizes(t *testing.T) {
 	}
 
 	for input, expected := range testTable {
-		actual := generateGroupSizes(input)
+		actual, err := generateGroupSizesWithOptions(input, DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
 		if !testEq(actual, expected) {
 			t.Errorf("For input %v Expected: %v but got: %v\n", input, expected, actual)
 		}
 	}
 }
+func TestGenerateGroupSizesWithOptions(t *testing.T) {
+	testTable := []struct {
+		size     int
+		opts     Options
+		expected []int
+	}{
+		{0, sizeOptions(2, 2, 3), []int{}},
+		{2, sizeOptions(2, 2, 3), []int{2}},
+		{5, sizeOptions(2, 2, 3), []int{3, 2}},
+		{7, sizeOptions(2, 2, 3), []int{3, 2, 2}},
+		{8, sizeOptions(2, 2, 2), []int{2, 2, 2, 2}},
+		{6, sizeOptions(5, 4, 6), []int{6}},
+		{9, sizeOptions(5, 4, 6), []int{5, 4}},
+		{13, sizeOptions(5, 4, 6), []int{5, 4, 4}},
+		{11, sizeOptions(6, 5, 6), []int{6, 5}},
+	}
+	for _, test := range testTable {
+		actual, err := generateGroupSizesWithOptions(test.size, test.opts)
+		if err != nil {
+			t.Fatalf("For input %d %v error is not expected: %v", test.size, test.opts, err)
+		}
+		if !testEq(actual, test.expected) {
+			t.Errorf("For input %d %v Expected: %v but got: %v", test.size, test.opts, test.expected, actual)
+		}
+	}
+}
+func TestGenerateGroupSizesWithOptionsShouldFailWhenBoundsCannotBeMet(t *testing.T) {
+	testTable := []struct {
+		size int
+		opts Options
+	}{
+		{1, sizeOptions(2, 2, 2)},
+		{3, sizeOptions(2, 2, 2)},
+		{7, sizeOptions(4, 4, 6)},
+		{5, sizeOptions(0, 1, 4)},
+		{5, sizeOptions(4, 5, 5)},
+		{5, sizeOptions(4, 1, 3)},
+	}
+	for _, test := range testTable {
+		if actual, err := generateGroupSizesWithOptions(test.size, test.opts); err == nil {
+			t.Errorf("For input %d %v error expected but got: %v", test.size, test.opts, actual)
+		}
+	}
+}
 func TestCalculateWeightedChoices(t *testing.T) {
 	users := []User{slackUser("ali"), slackUser("veli")}
 	bs := slackUser("tarik")
@@ -68,7 +180,7 @@ func TestCalculateWeightedChoices(t *testing.T) {
 		{[]UserRelation{}, []randutil.Choice{randutil.Choice{1, "ali"}, randutil.Choice{1, "veli"}}},
 	}
 	for _, test := range testTable {
-		actual := calculateWeightedChoices(bs, users, test.relations)
+		actual := calculateWeightedChoices([]User{bs}, users, encounterMap(test.relations), nil)
 		if len(actual) != len(test.expected) {
 			t.Errorf("Expected: %v Actual: %v", test.expected, actual)
 		}
@@ -79,13 +191,66 @@ func TestCalculateWeightedChoices(t *testing.T) {
 		}
 	}
 }
+func TestCalculateWeightedChoicesShouldScoreWholeGroup(t *testing.T) {
+	group := []User{slackUser("tarik"), slackUser("ali")}
+	users := []User{slackUser("veli"), slackUser("deli"), slackUser("can")}
+	encounters := encounterMap([]UserRelation{
+		UserRelation{User1: "ali", User2: "veli", Encounters: 10},
+		UserRelation{User1: "tarik", User2: "deli", Encounters: 2},
+		UserRelation{User1: "deli", User2: "ali", Encounters: 3},
+	})
+	expected := []randutil.Choice{randutil.Choice{1, "veli"}, randutil.Choice{6, "deli"}, randutil.Choice{11, "can"}}
+	actual := calculateWeightedChoices(group, users, encounters, nil)
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected: %v Actual: %v", expected, actual)
+	}
+}
+func TestGroupEncounters(t *testing.T) {
+	encounters := encounterMap([]UserRelation{
+		UserRelation{User1: "ali", User2: "veli", Encounters: 10},
+		UserRelation{User1: "tarik", User2: "deli", Encounters: 2},
+		UserRelation{User1: "deli", User2: "ali", Encounters: 3},
+	})
+	testTable := []struct {
+		group    []User
+		expected int
+	}{
+		{[]User{}, 0},
+		{[]User{slackUser("ali")}, 0},
+		{[]User{slackUser("ali"), slackUser("veli")}, 10},
+		{[]User{slackUser("tarik"), slackUser("ali"), slackUser("deli")}, 5},
+		{[]User{slackUser("tarik"), slackUser("ali"), slackUser("deli"), slackUser("veli")}, 15},
+	}
+	for _, test := range testTable {
+		if actual := groupEncounters(test.group, encounters); actual != test.expected {
+			t.Errorf("For group %v expected: %d but was: %d", userNames(test.group), test.expected, actual)
+		}
+	}
+}
+func TestBuildGroup(t *testing.T) {
+	candidates := []User{slackUser("ali"), slackUser("veli"), slackUser("deli")}
+	encounters := encounterMap([]UserRelation{UserRelation{User1: "ali", User2: "veli", Encounters: 5}})
+	group, err := buildGroup(rand.New(rand.NewSource(1)), []User{slackUser("tarik")}, candidates, encounters, placement{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group) != 3 || group[2].Name != "tarik" {
+		t.Fatalf("Group of 3 ending with the base user expected but was: %v", userNames(group))
+	}
+	if group[0].Name == group[1].Name {
+		t.Fatalf("Group members should be different! Group: %v", userNames(group))
+	}
+	if len(candidates) != 3 {
+		t.Fatalf("Candidates should not be modified but was: %v", userNames(candidates))
+	}
+}
 func TestCalculateRandomizedGroup(t *testing.T) {
 	choices := []randutil.Choice{
 		randutil.Choice{1, "ali"},
 		randutil.Choice{1, "veli"},
 		randutil.Choice{2, "deli"},
 	}
-	subgroup, err := calculateRandomizedGroup(choices, 2)
+	subgroup, err := calculateRandomizedGroup(rand.New(rand.NewSource(1)), choices, 2)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -112,23 +277,24 @@ func TestCalculateRandomizedGroup(t *testing.T) {
 	}
 }
 func TestCalculateRandomizedGroupFailsIfChoiceContainsNonString(t *testing.T) {
-	_, err := calculateRandomizedGroup([]randutil.Choice{randutil.Choice{1, 7}}, 2)
+	_, err := calculateRandomizedGroup(rand.New(rand.NewSource(1)), []randutil.Choice{randutil.Choice{1, 7}}, 2)
 	if err == nil {
 		t.Fatal("Error expected")
 	}
 
 }
-func TestConvertNamesToUsersShouldSucceed(t *testing.T) {
-	users := []User{slackUser("deli"), slackUser("ali"), slackUser("veli")}
+func TestConvertIDsToUsersShouldSucceed(t *testing.T) {
+	ali, veli, deli := User{ID: "U1", Name: "ali"}, User{ID: "U2", Name: "veli"}, User{ID: "U3", Name: "deli"}
+	users := []User{deli, ali, veli}
 	testTable := []struct {
-		inputNames []string
-		expected   []User
+		inputIDs []string
+		expected []User
 	}{
-		{[]string{"ali", "veli"}, []User{slackUser("ali"), slackUser("veli")}},
-		{[]string{"veli", "deli"}, []User{slackUser("veli"), slackUser("deli")}},
+		{[]string{"U1", "U2"}, []User{ali, veli}},
+		{[]string{"U2", "U3"}, []User{veli, deli}},
 	}
 	for _, test := range testTable {
-		actual, err := convertNamesToUsers(users, test.inputNames)
+		actual, err := convertIDsToUsers(users, test.inputIDs)
 		if err != nil {
 			t.Fatalf("Failed with error %v", err)
 		}
@@ -143,16 +309,16 @@ func TestConvertNamesToUsersShouldSucceed(t *testing.T) {
 	}
 }
 
-func TestConvertNamesToUsersShouldFailWhenNameIsNotInUsers(t *testing.T) {
+func TestConvertIDsToUsersShouldFailWhenIDIsNotInUsers(t *testing.T) {
 	testTable := []struct {
 		input    []string
 		expected error
 	}{
-		{[]string{"ali"}, errors.New("Error! The user list does not have a user with name [ali]!")},
-		{[]string{"veli", "ali"}, errors.New("Error! The user list does not have a user with name [veli]!")},
+		{[]string{"U1"}, errors.New("Error! The user list does not have a user with id [U1]!")},
+		{[]string{"U2", "U1"}, errors.New("Error! The user list does not have a user with id [U2]!")},
 	}
 	for _, test := range testTable {
-		_, err := convertNamesToUsers([]User{}, test.input)
+		_, err := convertIDsToUsers([]User{}, test.input)
 		if err == nil {
 			t.Fatalf("Function should have failed!")
 		}
@@ -212,6 +378,17 @@ func TestUpdateRelationsWithNewGroup(t *testing.T) {
 		}
 	}
 }
+func TestRelationsShouldBeKeyedByID(t *testing.T) {
+	renamed := []User{User{ID: "U1", Name: "ali.new"}, User{ID: "U2", Name: "ali"}}
+	relations := []UserRelation{UserRelation{User1: "U1", User2: "U2", Encounters: 3}}
+	expected := []UserRelation{UserRelation{User1: "U1", User2: "U2", Encounters: 4}}
+	if actual := updateRelationsWithNewGroup(relations, renamed); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected: %v but was: %v", expected, actual)
+	}
+	if e := groupEncounters(renamed, encounterMap(relations)); e != 3 {
+		t.Fatalf("Renamed users should keep their 3 encounters but it was: %d", e)
+	}
+}
 func TestUpdateRelationsShouldPanicWhenInputContainsDuplicateRelations(t *testing.T) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -247,10 +424,10 @@ func TestDeleteGroupFromUsers(t *testing.T) {
 		}
 	}
 }
-func userNames(users []User) []string {
-	names := make([]string, len(users))
-	for i, u := range users {
-		names[i] = u.Name
+func userGroupNames(groups [][]User) [][]string {
+	names := make([][]string, len(groups))
+	for i, g := range groups {
+		names[i] = userNames(g)
 	}
 	return names
 }
@@ -276,6 +453,13 @@ func testEq(a, b []int) bool {
 
 	return true
 }
+func sizeOptions(size, min, max int) Options {
+	opts := DefaultOptions()
+	opts.GroupSize = size
+	opts.MinGroupSize = min
+	opts.MaxGroupSize = max
+	return opts
+}
 func slackUser(name string) User {
-	return User{Name: name}
+	return User{ID: name, Name: name}
 }
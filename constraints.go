@@ -0,0 +1,249 @@
+package coffeetable
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	CONSTRAINT_APART    = "apart"
+	CONSTRAINT_TOGETHER = "together"
+	CONSTRAINT_PIN      = "pin"
+
+	MAX_CONSTRAINT_ATTEMPTS = 100
+	CONSTRAINT_PENALTY      = 1 << 20
+)
+
+var ErrConstraintsUnsatisfiable = errors.New("Group constraints cannot be satisfied for the current roster!")
+
+// errNoCandidate means a group could not be completed in one attempt, the
+// constraints may still be satisfiable with a different shuffle.
+var errNoCandidate = errors.New("No candidate satisfies the group constraints!")
+
+// Constraint is a hard rule for grouping. An apart constraint keeps User1
+// and User2 out of the same group, a together constraint puts them in the
+// same group and a pin constraint puts User1 in the Group numbered group,
+// counting from 1 as in the announcement. Users are Slack user IDs.
+type Constraint struct {
+	ID    int
+	Kind  string
+	User1 string
+	User2 string
+	Group int
+}
+
+type constraintSet struct {
+	apart    map[string]bool
+	together [][2]string
+	pins     map[string]int
+}
+
+func newConstraintSet(constraints []Constraint) constraintSet {
+	c := constraintSet{apart: make(map[string]bool), pins: make(map[string]int)}
+	for _, con := range constraints {
+		switch con.Kind {
+		case CONSTRAINT_APART:
+			c.apart[con.User1+"|"+con.User2] = true
+			c.apart[con.User2+"|"+con.User1] = true
+		case CONSTRAINT_TOGETHER:
+			c.together = append(c.together, [2]string{con.User1, con.User2})
+		case CONSTRAINT_PIN:
+			c.pins[con.User1] = con.Group - 1
+		}
+	}
+	return c
+}
+
+func (c constraintSet) allows(group []User, u User) bool {
+	for _, member := range group {
+		if c.apart[u.ID+"|"+member.ID] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c constraintSet) satisfiedBy(groups [][]User) bool {
+	for _, g := range groups {
+		for i := 1; i < len(g); i++ {
+			if !c.allows(g[:i], g[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// penalize returns a copy of encounters where every apart pair counts as
+// CONSTRAINT_PENALTY encounters, so optimizing drives them out of groups.
+func (c constraintSet) penalize(encounters map[string]int) map[string]int {
+	penalized := make(map[string]int)
+	for k, e := range encounters {
+		penalized[k] = e
+	}
+	for k := range c.apart {
+		penalized[k] += CONSTRAINT_PENALTY
+	}
+	return penalized
+}
+
+// repairGroups swaps members between groups until no group violates the
+// apart constraints, keeping the group sizes.
+func (c constraintSet) repairGroups(groups [][]User) ([][]User, error) {
+	groups = copyGroups(groups)
+	for i := range groups {
+		for m := 0; m < len(groups[i]); m++ {
+			others := append(append([]User{}, groups[i][:m]...), groups[i][m+1:]...)
+			if c.allows(others, groups[i][m]) {
+				continue
+			}
+			if !c.swapIntoOtherGroup(groups, i, m) {
+				return nil, ErrConstraintsUnsatisfiable
+			}
+			m = -1
+		}
+	}
+	return groups, nil
+}
+
+func (c constraintSet) swapIntoOtherGroup(groups [][]User, i int, m int) bool {
+	for j := range groups {
+		if j == i {
+			continue
+		}
+		for n := range groups[j] {
+			groups[i][m], groups[j][n] = groups[j][n], groups[i][m]
+			if c.satisfiedBy([][]User{groups[i], groups[j]}) {
+				return true
+			}
+			groups[i][m], groups[j][n] = groups[j][n], groups[i][m]
+		}
+	}
+	return false
+}
+
+// placement is a constraint set applied to a roster: clusters maps every
+// user who has to share a group with others to all members of that cluster,
+// pinned holds the users placed in each group before any choice is made.
+type placement struct {
+	constraintSet
+	clusters map[string][]User
+	pinned   [][]User
+}
+
+func (c constraintSet) place(users []User, groupSizes []int) (placement, error) {
+	p := placement{constraintSet: c, clusters: make(map[string][]User), pinned: make([][]User, len(groupSizes))}
+	userMap := make(map[string]User)
+	for _, u := range users {
+		userMap[u.ID] = u
+	}
+	parent := make(map[string]string)
+	root := func(name string) string {
+		for parent[name] != name {
+			name = parent[name]
+		}
+		return name
+	}
+	for _, pair := range c.together {
+		_, ok1 := userMap[pair[0]]
+		_, ok2 := userMap[pair[1]]
+		if !ok1 || !ok2 {
+			continue
+		}
+		for _, name := range pair {
+			if _, ok := parent[name]; !ok {
+				parent[name] = name
+			}
+		}
+		parent[root(pair[0])] = root(pair[1])
+	}
+	clusters := make(map[string][]User)
+	for _, u := range users {
+		if _, ok := parent[u.ID]; ok {
+			clusters[root(u.ID)] = append(clusters[root(u.ID)], u)
+		}
+	}
+	maxSize := 0
+	for _, s := range groupSizes {
+		if s > maxSize {
+			maxSize = s
+		}
+	}
+	for _, cluster := range clusters {
+		if !p.satisfiedBy([][]User{cluster}) {
+			return p, fmt.Errorf("%w Users %v must be together and apart at the same time.", ErrConstraintsUnsatisfiable, userNames(cluster))
+		}
+		if len(cluster) > maxSize {
+			return p, fmt.Errorf("%w Users %v must be together but groups have at most %d members.", ErrConstraintsUnsatisfiable, userNames(cluster), maxSize)
+		}
+		for _, u := range cluster {
+			p.clusters[u.ID] = cluster
+		}
+	}
+	pinnedTo := make(map[string]int)
+	for _, u := range users {
+		g, ok := c.pins[u.ID]
+		if !ok {
+			continue
+		}
+		if g < 0 || g >= len(groupSizes) {
+			return p, fmt.Errorf("%w %s is pinned to group %d but there are %d groups.", ErrConstraintsUnsatisfiable, u.Name, g+1, len(groupSizes))
+		}
+		cluster := p.clusterOf(u)
+		if other, ok := pinnedTo[cluster[0].ID]; ok {
+			if other != g {
+				return p, fmt.Errorf("%w Users %v are pinned to groups %d and %d.", ErrConstraintsUnsatisfiable, userNames(cluster), other+1, g+1)
+			}
+			continue
+		}
+		pinnedTo[cluster[0].ID] = g
+		p.pinned[g] = append(p.pinned[g], cluster...)
+		if len(p.pinned[g]) > groupSizes[g] || !p.satisfiedBy([][]User{p.pinned[g]}) {
+			return p, fmt.Errorf("%w Users %v cannot be pinned to group %d together.", ErrConstraintsUnsatisfiable, userNames(p.pinned[g]), g+1)
+		}
+	}
+	return p, nil
+}
+
+// clusterOf returns the users who have to be in the same group as u,
+// including u.
+func (p placement) clusterOf(u User) []User {
+	if cluster, ok := p.clusters[u.ID]; ok {
+		return cluster
+	}
+	return []User{u}
+}
+
+// allowedCandidates returns the candidates whose whole cluster fits in the
+// free places of group without breaking an apart constraint.
+func (p placement) allowedCandidates(group []User, candidates []User, free int) []User {
+	allowed := []User{}
+	for _, u := range candidates {
+		cluster := p.clusterOf(u)
+		if len(cluster) > free {
+			continue
+		}
+		ok := true
+		for _, member := range cluster {
+			ok = ok && p.allows(group, member)
+		}
+		if ok {
+			allowed = append(allowed, u)
+		}
+	}
+	return allowed
+}
+
+// fixed returns the users who cannot be moved to another group on their own.
+func (p placement) fixed() map[string]bool {
+	fixed := make(map[string]bool)
+	for name := range p.clusters {
+		fixed[name] = true
+	}
+	for _, g := range p.pinned {
+		for _, u := range g {
+			fixed[u.ID] = true
+		}
+	}
+	return fixed
+}
@@ -0,0 +1,191 @@
+package coffeetable
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestGroupersShouldNeverViolateApartConstraints(t *testing.T) {
+	inputUsers := namedUsers(6)
+	inputRelations := []UserRelation{UserRelation{User1: "u1", User2: "u2", Encounters: 1}}
+	constraints := []Constraint{
+		apart("u0", "u1"), apart("u0", "u2"), apart("u0", "u3"), apart("u1", "u2"),
+	}
+	for _, strategy := range []string{STRATEGY_WEIGHTED, STRATEGY_RANDOM, STRATEGY_ROUNDROBIN, STRATEGY_OPTIMIZE} {
+		for seed := int64(1); seed <= 20; seed++ {
+			opts := sizeOptions(2, 2, 2)
+			opts.Seed = seed
+			opts.Constraints = constraints
+			grouper, err := newTestGrouper(strategy, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups, _, err := grouper.Group(inputRelations, inputUsers)
+			if err != nil {
+				t.Fatalf("Strategy %s seed %d failed: %v", strategy, seed, err)
+			}
+			if !newConstraintSet(constraints).satisfiedBy(groups) {
+				t.Fatalf("Strategy %s seed %d violated constraints: %v", strategy, seed, userGroupNames(groups))
+			}
+		}
+	}
+}
+
+func TestGroupersShouldFailWhenConstraintsAreUnsatisfiable(t *testing.T) {
+	inputUsers := namedUsers(4)
+	opts := sizeOptions(2, 2, 2)
+	opts.Constraints = []Constraint{apart("u0", "u1"), apart("u0", "u2"), apart("u0", "u3")}
+	for _, strategy := range []string{STRATEGY_WEIGHTED, STRATEGY_RANDOM, STRATEGY_ROUNDROBIN, STRATEGY_OPTIMIZE} {
+		grouper, err := newTestGrouper(strategy, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if groups, _, err := grouper.Group([]UserRelation{}, inputUsers); err != ErrConstraintsUnsatisfiable {
+			t.Fatalf("Strategy %s, expected error: %v but was: %v with groups %v", strategy, ErrConstraintsUnsatisfiable, err, userGroupNames(groups))
+		}
+	}
+}
+
+func TestConstraintSetAllowedCandidates(t *testing.T) {
+	c := newConstraintSet([]Constraint{apart("ali", "veli"), apart("deli", "can"), Constraint{Kind: "unknown", User1: "ali", User2: "can"}})
+	group := []User{slackUser("ali"), slackUser("deli")}
+	candidates := []User{slackUser("veli"), slackUser("can"), slackUser("cem")}
+	expected := []string{"cem"}
+	if actual := userNames((placement{constraintSet: c}).allowedCandidates(group, candidates, 2)); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected: %v but was: %v", expected, actual)
+	}
+}
+
+func TestRepairGroups(t *testing.T) {
+	c := newConstraintSet([]Constraint{apart("ali", "veli")})
+	groups := [][]User{
+		[]User{slackUser("ali"), slackUser("veli")},
+		[]User{slackUser("deli"), slackUser("can")},
+	}
+	repaired, err := c.repairGroups(groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.satisfiedBy(repaired) {
+		t.Fatalf("Repaired groups violate constraints: %v", userGroupNames(repaired))
+	}
+	if groups[0][1].Name != "veli" {
+		t.Fatalf("Input groups should not be modified: %v", userGroupNames(groups))
+	}
+	if _, err := c.repairGroups([][]User{[]User{slackUser("ali"), slackUser("veli")}}); err != ErrConstraintsUnsatisfiable {
+		t.Fatalf("Expected error: %v but was: %v", ErrConstraintsUnsatisfiable, err)
+	}
+}
+
+func TestGroupersShouldKeepTogetherAndPinnedUsers(t *testing.T) {
+	inputUsers := namedUsers(10)
+	inputRelations := []UserRelation{
+		UserRelation{User1: "u0", User2: "u1", Encounters: 5},
+		UserRelation{User1: "u4", User2: "u5", Encounters: 2},
+	}
+	constraints := []Constraint{
+		together("u0", "u1"), together("u1", "u2"), pin("u3", 3), together("u3", "u4"), pin("u5", 3), apart("u6", "u7"),
+	}
+	for _, strategy := range []string{STRATEGY_WEIGHTED, STRATEGY_RANDOM, STRATEGY_OPTIMIZE} {
+		for seed := int64(1); seed <= 20; seed++ {
+			opts := sizeOptions(3, 3, 4)
+			opts.Seed = seed
+			opts.Constraints = constraints
+			grouper, err := newTestGrouper(strategy, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups, relations, err := grouper.Group(inputRelations, inputUsers)
+			if err != nil {
+				t.Fatalf("Strategy %s seed %d failed: %v", strategy, seed, err)
+			}
+			if len(groups) != 3 || len(groups[0])+len(groups[1])+len(groups[2]) != len(inputUsers) {
+				t.Fatalf("Strategy %s seed %d, every user should be grouped: %v", strategy, seed, userGroupNames(groups))
+			}
+			if !groupsContainPair(groups, "u0", "u1") || !groupsContainPair(groups, "u1", "u2") {
+				t.Fatalf("Strategy %s seed %d, u0, u1 and u2 should be together: %v", strategy, seed, userGroupNames(groups))
+			}
+			pinned := userNames(groups[2])
+			if !containsName(pinned, "u3") || !containsName(pinned, "u4") || !containsName(pinned, "u5") {
+				t.Fatalf("Strategy %s seed %d, u3, u4 and u5 should be in group 3: %v", strategy, seed, userGroupNames(groups))
+			}
+			if groupsContainPair(groups, "u6", "u7") {
+				t.Fatalf("Strategy %s seed %d, u6 and u7 should be apart: %v", strategy, seed, userGroupNames(groups))
+			}
+			if e := encounterMap(relations)["u0|u1"]; e != 6 {
+				t.Fatalf("Strategy %s seed %d, encounter of u0 and u1 should be recorded, it was: %d", strategy, seed, e)
+			}
+		}
+	}
+}
+
+func TestGroupersShouldFailWhenPlacementIsUnsatisfiable(t *testing.T) {
+	testTable := [][]Constraint{
+		[]Constraint{together("u0", "u1"), apart("u1", "u0")},
+		[]Constraint{together("u0", "u1"), together("u1", "u2"), together("u2", "u3")},
+		[]Constraint{pin("u0", 4)},
+		[]Constraint{pin("u0", 0)},
+		[]Constraint{together("u0", "u1"), pin("u0", 1), pin("u1", 2)},
+		[]Constraint{pin("u0", 1), pin("u1", 1), pin("u2", 1), pin("u3", 1)},
+		[]Constraint{pin("u0", 1), pin("u1", 1), apart("u0", "u1")},
+	}
+	for i, constraints := range testTable {
+		for _, strategy := range []string{STRATEGY_WEIGHTED, STRATEGY_RANDOM, STRATEGY_OPTIMIZE} {
+			opts := sizeOptions(3, 3, 3)
+			opts.Constraints = constraints
+			grouper, err := newTestGrouper(strategy, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := grouper.Group([]UserRelation{}, namedUsers(9)); !errors.Is(err, ErrConstraintsUnsatisfiable) {
+				t.Fatalf("Test %d strategy %s, expected error: %v but was: %v", i, strategy, ErrConstraintsUnsatisfiable, err)
+			}
+		}
+	}
+}
+
+func TestRoundRobinGrouperShouldRefuseTogetherAndPinConstraints(t *testing.T) {
+	for _, c := range []Constraint{together("u0", "u1"), pin("u0", 1)} {
+		opts := DefaultOptions()
+		opts.Constraints = []Constraint{c}
+		if _, _, err := (&RoundRobinGrouper{Options: opts, Schedule: &CircleSchedule{}}).Group([]UserRelation{}, namedUsers(4)); err == nil {
+			t.Fatalf("Error expected for %s constraint", c.Kind)
+		}
+	}
+}
+
+func TestPlaceShouldIgnoreAbsentUsers(t *testing.T) {
+	c := newConstraintSet([]Constraint{together("u0", "u9"), pin("u8", 1), together("u1", "u2")})
+	p, err := c.place(namedUsers(4), []int{2, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.clusterOf(slackUser("u0"))) != 1 || len(p.pinned[0]) != 0 {
+		t.Fatalf("Constraints of absent users should be ignored: %v", p)
+	}
+	if actual := userNames(p.clusterOf(slackUser("u2"))); !reflect.DeepEqual(actual, []string{"u1", "u2"}) {
+		t.Fatalf("u1 and u2 should be clustered but was: %v", actual)
+	}
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func together(user1, user2 string) Constraint {
+	return Constraint{Kind: CONSTRAINT_TOGETHER, User1: user1, User2: user2}
+}
+
+func pin(user string, group int) Constraint {
+	return Constraint{Kind: CONSTRAINT_PIN, User1: user, Group: group}
+}
+
+func apart(user1, user2 string) Constraint {
+	return Constraint{Kind: CONSTRAINT_APART, User1: user1, User2: user2}
+}
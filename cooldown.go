@@ -0,0 +1,54 @@
+package coffeetable
+
+import (
+	"errors"
+	"sort"
+)
+
+// cooldownConstraints keeps apart every pair of Encounters who met in one of
+// the last rounds rounds, a round being all encounters at the same instant
+// whatever its location.
+func cooldownConstraints(encounters []Encounter, rounds int) []Constraint {
+	if rounds <= 0 {
+		return nil
+	}
+	dates := []int64{}
+	seen := make(map[int64]bool)
+	for _, e := range encounters {
+		if date := e.Date.UnixNano(); !seen[date] {
+			seen[date] = true
+			dates = append(dates, date)
+		}
+	}
+	sort.Slice(dates, func(i, j int) bool { return dates[i] > dates[j] })
+	if len(dates) > rounds {
+		dates = dates[:rounds]
+	}
+	recent := make(map[int64]bool)
+	for _, d := range dates {
+		recent[d] = true
+	}
+	constraints := []Constraint{}
+	for _, e := range encounters {
+		if recent[e.Date.UnixNano()] {
+			constraints = append(constraints, Constraint{Kind: CONSTRAINT_APART, User1: e.User1, User2: e.User2})
+		}
+	}
+	return constraints
+}
+
+// withCooldown runs generate with opts.Constraints and the cooldown of the
+// last opts.CooldownRounds rounds. When the roster is too small for the
+// cooldown, it is relaxed one round at a time. It returns the number of
+// rounds the groups respect, for the caller to report a relaxation.
+func withCooldown(opts Options, generate func(constraintSet) ([][]User, error)) ([][]User, int, error) {
+	rounds := opts.CooldownRounds
+	for {
+		constraints := append(append([]Constraint{}, opts.Constraints...), cooldownConstraints(opts.Encounters, rounds)...)
+		groups, err := generate(newConstraintSet(constraints))
+		if err == nil || rounds <= 0 || !errors.Is(err, ErrConstraintsUnsatisfiable) {
+			return groups, rounds, err
+		}
+		rounds--
+	}
+}
@@ -0,0 +1,92 @@
+package coffeetable
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCooldownConstraintsShouldKeepLastRounds(t *testing.T) {
+	day := 24 * time.Hour
+	now := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	// the same round loaded in another location is still one round
+	encounters := []Encounter{
+		Encounter{"ali", "veli", now.Add(-2 * day)},
+		Encounter{"can", "cem", now},
+		Encounter{"ali", "deli", now.Add(-day)},
+		Encounter{"cem", "deli", now.In(time.FixedZone("TRT", 3*60*60))},
+	}
+	tests := []struct {
+		rounds   int
+		expected []string
+	}{
+		{0, []string{}},
+		{1, []string{"can|cem", "cem|deli"}},
+		{2, []string{"can|cem", "ali|deli", "cem|deli"}},
+		{5, []string{"ali|veli", "can|cem", "ali|deli", "cem|deli"}},
+	}
+	for _, test := range tests {
+		actual := []string{}
+		for _, c := range cooldownConstraints(encounters, test.rounds) {
+			if c.Kind != CONSTRAINT_APART {
+				t.Fatalf("Apart constraint expected but it was: %v", c)
+			}
+			actual = append(actual, c.User1+"|"+c.User2)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Rounds %d, expected: %v but was: %v", test.rounds, test.expected, actual)
+		}
+	}
+}
+
+func TestGroupersShouldNotRepeatPairsInCooldown(t *testing.T) {
+	now := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	inputUsers := namedUsers(6)
+	opts := sizeOptions(2, 2, 2)
+	opts.CooldownRounds = 2
+	opts.Encounters = append(
+		NewEncounters([][]User{inputUsers[0:2], inputUsers[2:4], inputUsers[4:6]}, now.Add(-7*24*time.Hour)),
+		NewEncounters([][]User{inputUsers[1:3], inputUsers[3:5], []User{inputUsers[5], inputUsers[0]}}, now)...)
+	for _, strategy := range []string{STRATEGY_WEIGHTED, STRATEGY_RANDOM, STRATEGY_OPTIMIZE} {
+		for seed := int64(1); seed <= 10; seed++ {
+			opts.Seed = seed
+			grouper, err := newTestGrouper(strategy, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups, _, err := grouper.Group([]UserRelation{}, inputUsers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range opts.Encounters {
+				if groupsContainPair(groups, e.User1, e.User2) {
+					t.Fatalf("%s, seed %d, %s and %s met in cooldown: %v", strategy, seed, e.User1, e.User2, userGroupNames(groups))
+				}
+			}
+		}
+	}
+}
+
+func TestWithCooldownShouldRelaxForSmallRoster(t *testing.T) {
+	now := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	inputUsers := namedUsers(4)
+	opts := sizeOptions(2, 2, 2)
+	opts.CooldownRounds = 3
+	opts.Encounters = append(append(
+		NewEncounters([][]User{inputUsers[0:2], inputUsers[2:4]}, now.Add(-14*24*time.Hour)),
+		NewEncounters([][]User{[]User{inputUsers[0], inputUsers[2]}, []User{inputUsers[1], inputUsers[3]}}, now.Add(-7*24*time.Hour))...),
+		NewEncounters([][]User{[]User{inputUsers[0], inputUsers[3]}, []User{inputUsers[1], inputUsers[2]}}, now)...)
+	groups, rounds, err := withCooldown(opts, func(constraints constraintSet) ([][]User, error) {
+		return generateGroups(rand.New(rand.NewSource(1)), inputUsers, []int{2, 2}, map[string]int{}, constraints)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rounds != 2 {
+		t.Fatalf("Cooldown should be relaxed to 2 rounds but it was: %d", rounds)
+	}
+	if groupsContainPair(groups, "u0", "u3") || groupsContainPair(groups, "u0", "u2") {
+		t.Fatalf("Pairs of the last 2 rounds should not meet: %v", userGroupNames(groups))
+	}
+}
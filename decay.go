@@ -0,0 +1,77 @@
+package coffeetable
+
+import (
+	"math"
+	"time"
+)
+
+// DECAY_SCALE is the weight of a single encounter happening right now when
+// encounters decay, older encounters weigh proportionally less.
+const DECAY_SCALE = 100
+
+// Encounter is a single meeting of two users, by Slack user ID, in the round
+// held at Date.
+type Encounter struct {
+	User1 string
+	User2 string
+	Date  time.Time
+}
+
+func NewEncounters(groups [][]User, date time.Time) []Encounter {
+	encounters := []Encounter{}
+	for _, g := range groups {
+		for i := 0; i < len(g)-1; i++ {
+			for j := i + 1; j < len(g); j++ {
+				encounters = append(encounters, Encounter{g[i].ID, g[j].ID, date})
+			}
+		}
+	}
+	return encounters
+}
+
+// weightedEncounterMap returns the encounters grouping should avoid. Without
+// a half-life every encounter counts the same, otherwise an encounter
+// weighs DECAY_SCALE halved for every half-life passed since its round.
+// Encounters counted in relations but not dated count as old as the oldest
+// dated encounter.
+func weightedEncounterMap(relations []UserRelation, opts Options) map[string]int {
+	if opts.HalfLife <= 0 {
+		return encounterMap(relations)
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	oldest := now
+	dated := make(map[string]int)
+	decayed := make(map[string]float64)
+	for _, e := range opts.Encounters {
+		if e.Date.Before(oldest) {
+			oldest = e.Date
+		}
+		dated[e.User1+"|"+e.User2]++
+		dated[e.User2+"|"+e.User1]++
+		w := decay(now.Sub(e.Date), opts.HalfLife)
+		decayed[e.User1+"|"+e.User2] += w
+		decayed[e.User2+"|"+e.User1] += w
+	}
+	for _, r := range relations {
+		if undated := r.Encounters - dated[r.User1+"|"+r.User2]; undated > 0 {
+			w := float64(undated) * decay(now.Sub(oldest), opts.HalfLife)
+			decayed[r.User1+"|"+r.User2] += w
+			decayed[r.User2+"|"+r.User1] += w
+		}
+	}
+	weighted := make(map[string]int)
+	for k, w := range decayed {
+		weighted[k] = int(math.Round(w * DECAY_SCALE))
+	}
+	return weighted
+}
+
+func decay(age time.Duration, halfLife time.Duration) float64 {
+	if age < 0 {
+		age = 0
+	}
+	return math.Pow(0.5, float64(age)/float64(halfLife))
+}
@@ -0,0 +1,88 @@
+package coffeetable
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewEncounters(t *testing.T) {
+	date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	groups := [][]User{
+		[]User{slackUser("ali"), slackUser("veli"), slackUser("deli")},
+		[]User{slackUser("can"), slackUser("cem")},
+	}
+	expected := []Encounter{
+		Encounter{"ali", "veli", date}, Encounter{"ali", "deli", date}, Encounter{"veli", "deli", date}, Encounter{"can", "cem", date},
+	}
+	if actual := NewEncounters(groups, date); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected: %v but was: %v", expected, actual)
+	}
+}
+
+func TestWeightedEncounterMapShouldDecayOldEncounters(t *testing.T) {
+	now := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	week := 7 * 24 * time.Hour
+	relations := []UserRelation{
+		UserRelation{User1: "ali", User2: "veli", Encounters: 2},
+		UserRelation{User1: "ali", User2: "deli", Encounters: 1},
+		UserRelation{User1: "can", User2: "cem", Encounters: 3},
+	}
+	opts := DefaultOptions()
+	opts.HalfLife = week
+	opts.Now = now
+	opts.Encounters = []Encounter{
+		Encounter{"ali", "veli", now},
+		Encounter{"veli", "ali", now.Add(-2 * week)},
+		Encounter{"deli", "ali", now.Add(-4 * week)},
+		Encounter{"can", "cem", now.Add(-week)},
+	}
+	actual := weightedEncounterMap(relations, opts)
+	expected := map[string]int{
+		"ali|veli": 125, "veli|ali": 125,
+		"ali|deli": 6, "deli|ali": 6,
+		// two undated encounters count as old as the oldest one, 4 weeks
+		"can|cem": 50 + 13, "cem|can": 50 + 13,
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected: %v but was: %v", expected, actual)
+	}
+
+	opts.HalfLife = 0
+	if actual := weightedEncounterMap(relations, opts); !reflect.DeepEqual(actual, encounterMap(relations)) {
+		t.Fatalf("Without half-life encounters should not decay, it was: %v", actual)
+	}
+}
+
+func TestGenerateGroupsShouldPreferPairsThatMetLongAgo(t *testing.T) {
+	now := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	inputUsers := []User{slackUser("ali"), slackUser("veli"), slackUser("deli")}
+	relations := []UserRelation{
+		UserRelation{User1: "ali", User2: "veli", Encounters: 5},
+		UserRelation{User1: "ali", User2: "deli", Encounters: 1},
+	}
+	opts := sizeOptions(2, 1, 2)
+	opts.HalfLife = 24 * time.Hour
+	opts.Now = now
+	opts.Encounters = []Encounter{Encounter{"ali", "deli", now}}
+	for i := 0; i < 5; i++ {
+		opts.Encounters = append(opts.Encounters, Encounter{"ali", "veli", now.Add(-365 * 24 * time.Hour)})
+	}
+	aliWithVeli := 0
+	for seed := int64(1); seed <= 50; seed++ {
+		opts.Seed = seed
+		groups, _, err := GenerateGroupsWithOptions(relations, inputUsers, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if groupsContainPair(groups, "ali", "veli") {
+			aliWithVeli++
+		}
+		if groupsContainPair(groups, "ali", "deli") {
+			aliWithVeli--
+		}
+	}
+	if aliWithVeli <= 0 {
+		t.Fatalf("ali should meet veli, whom they met a year ago, more often than deli, whom they met today")
+	}
+}
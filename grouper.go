@@ -0,0 +1,130 @@
+package coffeetable
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+)
+
+// Grouper splits users into groups and returns the groups together with the
+// relations updated by them.
+type Grouper interface {
+	Group(relations []UserRelation, users []User) ([][]User, []UserRelation, error)
+}
+
+// CooldownGrouper is a Grouper keeping apart pairs who met in the last
+// Options.CooldownRounds rounds. Cooldown returns the rounds the last groups
+// respect, fewer when the roster was too small for the whole cooldown.
+type CooldownGrouper interface {
+	Grouper
+	Cooldown() int
+}
+
+const (
+	STRATEGY_WEIGHTED   = "weighted"
+	STRATEGY_RANDOM     = "random"
+	STRATEGY_ROUNDROBIN = "roundrobin"
+	STRATEGY_OPTIMIZE   = "optimize"
+)
+
+func NewGrouper(strategy string, opts Options) (Grouper, error) {
+	switch strategy {
+	case "", STRATEGY_WEIGHTED:
+		return &WeightedGrouper{Options: opts}, nil
+	case STRATEGY_RANDOM:
+		return &RandomGrouper{Options: opts}, nil
+	case STRATEGY_ROUNDROBIN:
+		return &RoundRobinGrouper{Options: opts}, nil
+	case STRATEGY_OPTIMIZE:
+		return &OptimizingGrouper{Options: opts}, nil
+	}
+	return nil, fmt.Errorf("Unknown grouping strategy: %s", strategy)
+}
+
+// WeightedGrouper favours people who met less often, see GenerateGroupsWithOptions.
+type WeightedGrouper struct {
+	Options  Options
+	cooldown int
+}
+
+func (g *WeightedGrouper) Group(relations []UserRelation, users []User) (groups [][]User, newRelations []UserRelation, err error) {
+	groups, newRelations, g.cooldown, err = generateGroupsWithOptions(relations, users, g.Options)
+	return
+}
+func (g *WeightedGrouper) Cooldown() int {
+	return g.cooldown
+}
+
+// RandomGrouper ignores past encounters and shuffles users into groups.
+type RandomGrouper struct {
+	Options  Options
+	cooldown int
+}
+
+func (g *RandomGrouper) Group(relations []UserRelation, users []User) ([][]User, []UserRelation, error) {
+	groupSizes, err := generateGroupSizesWithOptions(len(users), g.Options)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups, cooldown, err := withCooldown(g.Options, func(constraints constraintSet) ([][]User, error) {
+		rnd := rand.New(rand.NewSource(g.Options.Seed))
+		return generateGroups(rnd, sortUsers(users), groupSizes, map[string]int{}, constraints)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	g.cooldown = cooldown
+	return groups, recordGroups(relations, groups), nil
+}
+func (g *RandomGrouper) Cooldown() int {
+	return g.cooldown
+}
+
+// RoundRobinGrouper pairs users with the circle method, so everyone meets
+// everyone else once before any pair repeats. It ignores group sizes and
+// past encounters and does not use any randomness. Pairs violating apart
+// constraints are fixed by swapping partners, other constraints are refused.
+// Schedule has to be loaded by the caller, it is advanced on every call and
+// has to be persisted by the caller, a fresh schedule every time would
+// repeat the same pairs.
+type RoundRobinGrouper struct {
+	Options  Options
+	Schedule *CircleSchedule
+}
+
+func (g *RoundRobinGrouper) Group(relations []UserRelation, users []User) ([][]User, []UserRelation, error) {
+	constraints := newConstraintSet(g.Options.Constraints)
+	if len(constraints.together) > 0 || len(constraints.pins) > 0 {
+		return nil, nil, errors.New("Round robin schedule supports only apart constraints!")
+	}
+	if g.Schedule == nil {
+		return nil, nil, errors.New("Round robin schedule is missing, it should be loaded from the last round!")
+	}
+	groups, err := constraints.repairGroups(g.Schedule.Next(users))
+	if err != nil {
+		return nil, nil, err
+	}
+	return groups, recordGroups(relations, groups), nil
+}
+
+// OptimizingGrouper searches for the groups with the least repeat encounters,
+// see OptimizeGroups.
+type OptimizingGrouper struct {
+	Options  Options
+	cooldown int
+}
+
+func (g *OptimizingGrouper) Group(relations []UserRelation, users []User) (groups [][]User, newRelations []UserRelation, err error) {
+	groups, newRelations, g.cooldown, err = optimizeGroups(relations, users, g.Options)
+	return
+}
+func (g *OptimizingGrouper) Cooldown() int {
+	return g.cooldown
+}
+
+func recordGroups(relations []UserRelation, groups [][]User) []UserRelation {
+	for _, group := range groups {
+		relations = updateRelationsWithNewGroup(relations, group)
+	}
+	return relations
+}
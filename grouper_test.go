@@ -0,0 +1,119 @@
+package coffeetable
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNewGrouper(t *testing.T) {
+	opts := DefaultOptions()
+	testTable := []struct {
+		strategy string
+		expected Grouper
+	}{
+		{"", &WeightedGrouper{Options: opts}},
+		{STRATEGY_WEIGHTED, &WeightedGrouper{Options: opts}},
+		{STRATEGY_RANDOM, &RandomGrouper{Options: opts}},
+		{STRATEGY_ROUNDROBIN, &RoundRobinGrouper{Options: opts}},
+		{STRATEGY_OPTIMIZE, &OptimizingGrouper{Options: opts}},
+	}
+	for _, test := range testTable {
+		actual, err := NewGrouper(test.strategy, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("For strategy %s expected: %v but was: %v", test.strategy, reflect.TypeOf(test.expected), reflect.TypeOf(actual))
+		}
+	}
+	if _, err := NewGrouper("alphabetical", opts); err == nil {
+		t.Fatal("Error expected for unknown strategy")
+	}
+}
+
+func TestGroupersShouldGroupEveryUserOnce(t *testing.T) {
+	inputUsers := []User{slackUser("tarik"), slackUser("ali"), slackUser("veli"), slackUser("deli"), slackUser("can"), slackUser("cem"), slackUser("naz")}
+	inputRelations := []UserRelation{UserRelation{User1: "tarik", User2: "ali", Encounters: 2}}
+	for _, strategy := range []string{STRATEGY_WEIGHTED, STRATEGY_RANDOM, STRATEGY_OPTIMIZE} {
+		grouper, err := NewGrouper(strategy, DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups, relations, err := grouper.Group(inputRelations, inputUsers)
+		if err != nil {
+			t.Fatalf("Strategy %s failed: %v", strategy, err)
+		}
+		if len(groups) != 2 || len(groups[0]) != 4 || len(groups[1]) != 3 {
+			t.Fatalf("Strategy %s, groups of 4 and 3 users expected but it was: %v", strategy, userGroupNames(groups))
+		}
+		seen := make(map[string]bool)
+		for _, g := range groups {
+			for _, u := range g {
+				if seen[u.Name] {
+					t.Fatalf("Strategy %s, %s is grouped twice: %v", strategy, u.Name, userGroupNames(groups))
+				}
+				seen[u.Name] = true
+			}
+		}
+		if len(seen) != len(inputUsers) {
+			t.Fatalf("Strategy %s, every user should be grouped: %v", strategy, userGroupNames(groups))
+		}
+		expectedRelations := 10
+		if groupsContainPair(groups, "tarik", "ali") {
+			expectedRelations--
+		}
+		if len(relations) != expectedRelations {
+			t.Fatalf("Strategy %s, %d relations expected but it was: %v", strategy, expectedRelations, relations)
+		}
+	}
+}
+
+func TestRoundRobinGrouperShouldAdvanceSchedule(t *testing.T) {
+	inputUsers := []User{slackUser("d"), slackUser("b"), slackUser("a"), slackUser("c")}
+	grouper := &RoundRobinGrouper{Options: DefaultOptions(), Schedule: &CircleSchedule{}}
+	groups, relations, err := grouper.Group([]UserRelation{}, inputUsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{[]string{"a", "d"}, []string{"b", "c"}}
+	if !reflect.DeepEqual(userGroupNames(groups), expected) {
+		t.Fatalf("Expected: %v but was: %v", expected, userGroupNames(groups))
+	}
+	if len(relations) != 2 {
+		t.Fatalf("2 relations expected but it was: %v", relations)
+	}
+	if grouper.Schedule.Round != 1 {
+		t.Fatalf("Schedule should be at round 1 but was: %v", grouper.Schedule)
+	}
+}
+func TestRoundRobinGrouperShouldRefuseMissingSchedule(t *testing.T) {
+	if _, _, err := (&RoundRobinGrouper{Options: DefaultOptions()}).Group([]UserRelation{}, namedUsers(4)); err == nil {
+		t.Fatal("Error expected without a schedule")
+	}
+}
+
+// newTestGrouper returns the grouper of strategy, a round robin one with a
+// fresh schedule.
+func newTestGrouper(strategy string, opts Options) (Grouper, error) {
+	grouper, err := NewGrouper(strategy, opts)
+	if roundRobin, ok := grouper.(*RoundRobinGrouper); ok {
+		roundRobin.Schedule = &CircleSchedule{}
+	}
+	return grouper, err
+}
+
+func groupsContainPair(groups [][]User, user1, user2 string) bool {
+	for _, g := range groups {
+		names := userNames(g)
+		found := 0
+		for _, n := range names {
+			if n == user1 || n == user2 {
+				found++
+			}
+		}
+		if found == 2 {
+			return true
+		}
+	}
+	return false
+}
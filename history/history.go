@@ -0,0 +1,302 @@
+package history
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ct "github.com/mtyurt/coffeetable"
+	"github.com/mtyurt/coffeetable/repo"
+)
+
+const (
+	KIND_RELATIONS = "relations"
+	KIND_ROUNDS    = "rounds"
+
+	FORMAT_CSV  = "csv"
+	FORMAT_JSON = "json"
+)
+
+var (
+	relationHeader = []string{"user1", "user2", "encounters"}
+	roundHeader    = []string{"date", "channel", "strategy", "seed", "group", "user"}
+)
+
+// Data is exported or imported history. Users are Slack user IDs, or names
+// before ResolveUsers.
+type Data struct {
+	Relations []ct.UserRelation
+	Rounds    []ct.Round
+}
+
+type relationRecord struct {
+	User1      string `json:"user1"`
+	User2      string `json:"user2"`
+	Encounters int    `json:"encounters"`
+}
+type roundRecord struct {
+	Date     time.Time  `json:"date"`
+	Channel  string     `json:"channel"`
+	Strategy string     `json:"strategy"`
+	Seed     int64      `json:"seed"`
+	Groups   [][]string `json:"groups"`
+}
+
+func checkKindAndFormat(kind string, format string) error {
+	if kind != KIND_RELATIONS && kind != KIND_ROUNDS {
+		return fmt.Errorf("Unknown history kind: %s", kind)
+	}
+	if format != FORMAT_CSV && format != FORMAT_JSON {
+		return fmt.Errorf("Unknown history format: %s", format)
+	}
+	return nil
+}
+
+// Export returns the relations and the rounds of a program, leaving out
+// rolled back rounds.
+func Export(r repo.Repo, scope repo.Scope) (data Data, err error) {
+	if data.Relations, err = r.GetUserRelations(scope); err != nil {
+		return
+	}
+	rounds, err := r.GetRounds(scope)
+	if err != nil {
+		return
+	}
+	for _, round := range rounds {
+		if !round.Reverted {
+			data.Rounds = append(data.Rounds, round)
+		}
+	}
+	return
+}
+
+// Write writes the relations or the rounds of data in format. Rounds in CSV
+// take a row per group member.
+func Write(w io.Writer, kind string, format string, data Data) error {
+	if err := checkKindAndFormat(kind, format); err != nil {
+		return err
+	}
+	if format == FORMAT_JSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if kind == KIND_RELATIONS {
+			records := []relationRecord{}
+			for _, rel := range data.Relations {
+				records = append(records, relationRecord{rel.User1, rel.User2, rel.Encounters})
+			}
+			return enc.Encode(records)
+		}
+		records := []roundRecord{}
+		for _, round := range data.Rounds {
+			records = append(records, roundRecord{round.Date, round.Channel, round.Strategy, round.Seed, round.Groups})
+		}
+		return enc.Encode(records)
+	}
+
+	cw := csv.NewWriter(w)
+	if kind == KIND_RELATIONS {
+		cw.Write(relationHeader)
+		for _, rel := range data.Relations {
+			cw.Write([]string{rel.User1, rel.User2, strconv.Itoa(rel.Encounters)})
+		}
+	} else {
+		cw.Write(roundHeader)
+		for _, round := range data.Rounds {
+			for i, g := range round.Groups {
+				for _, user := range g {
+					cw.Write([]string{round.Date.Format(time.RFC3339), round.Channel, round.Strategy, strconv.FormatInt(round.Seed, 10), strconv.Itoa(i + 1), user})
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Read reads relations or rounds written by Write and validates them.
+func Read(r io.Reader, kind string, format string) (data Data, err error) {
+	if err = checkKindAndFormat(kind, format); err != nil {
+		return
+	}
+	switch {
+	case format == FORMAT_JSON && kind == KIND_RELATIONS:
+		records := []relationRecord{}
+		if err = json.NewDecoder(r).Decode(&records); err != nil {
+			return
+		}
+		for _, rec := range records {
+			data.Relations = append(data.Relations, ct.UserRelation{User1: rec.User1, User2: rec.User2, Encounters: rec.Encounters})
+		}
+	case format == FORMAT_JSON:
+		records := []roundRecord{}
+		if err = json.NewDecoder(r).Decode(&records); err != nil {
+			return
+		}
+		for _, rec := range records {
+			data.Rounds = append(data.Rounds, ct.Round{Date: rec.Date, Channel: rec.Channel, Strategy: rec.Strategy, Seed: rec.Seed, Groups: rec.Groups})
+		}
+	case kind == KIND_RELATIONS:
+		data.Relations, err = readRelationsCSV(r)
+	default:
+		data.Rounds, err = readRoundsCSV(r)
+	}
+	if err != nil {
+		return
+	}
+	return data, Validate(data)
+}
+
+func readCSV(r io.Reader, header []string) ([][]string, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(header)
+	cr.TrimLeadingSpace = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || strings.Join(rows[0], ",") != strings.Join(header, ",") {
+		return nil, fmt.Errorf("CSV header should be: %s", strings.Join(header, ","))
+	}
+	return rows[1:], nil
+}
+func readRelationsCSV(r io.Reader) ([]ct.UserRelation, error) {
+	rows, err := readCSV(r, relationHeader)
+	if err != nil {
+		return nil, err
+	}
+	relations := []ct.UserRelation{}
+	for i, row := range rows {
+		encounters, err := strconv.Atoi(row[2])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: encounters should be a number: %s", i+2, row[2])
+		}
+		relations = append(relations, ct.UserRelation{User1: row[0], User2: row[1], Encounters: encounters})
+	}
+	return relations, nil
+}
+
+// readRoundsCSV groups member rows into rounds by date and channel, keeping
+// the order rounds and groups first appear in.
+func readRoundsCSV(r io.Reader) ([]ct.Round, error) {
+	rows, err := readCSV(r, roundHeader)
+	if err != nil {
+		return nil, err
+	}
+	rounds := []ct.Round{}
+	index := make(map[string]int)
+	for i, row := range rows {
+		date, err := time.Parse(time.RFC3339, row[0])
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: date should be in RFC 3339 format: %s", i+2, row[0])
+		}
+		seed, err := strconv.ParseInt(row[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: seed should be a number: %s", i+2, row[3])
+		}
+		group, err := strconv.Atoi(row[4])
+		if err != nil || group < 1 {
+			return nil, fmt.Errorf("Line %d: group should be a positive number: %s", i+2, row[4])
+		}
+		key := date.Format(time.RFC3339Nano) + "|" + row[1]
+		n, ok := index[key]
+		if !ok {
+			n = len(rounds)
+			index[key] = n
+			rounds = append(rounds, ct.Round{Date: date, Channel: row[1], Strategy: row[2], Seed: seed})
+		}
+		for len(rounds[n].Groups) < group {
+			rounds[n].Groups = append(rounds[n].Groups, []string{})
+		}
+		rounds[n].Groups[group-1] = append(rounds[n].Groups[group-1], row[5])
+	}
+	return rounds, nil
+}
+
+// Validate reports every invalid relation and round of data at once.
+func Validate(data Data) error {
+	problems := []string{}
+	for i, rel := range data.Relations {
+		switch {
+		case rel.User1 == "" || rel.User2 == "":
+			problems = append(problems, fmt.Sprintf("Relation %d: users should not be empty", i+1))
+		case rel.User1 == rel.User2:
+			problems = append(problems, fmt.Sprintf("Relation %d: %s cannot meet themselves", i+1, rel.User1))
+		case rel.Encounters < 0:
+			problems = append(problems, fmt.Sprintf("Relation %d: encounters should not be negative", i+1))
+		}
+	}
+	for i, round := range data.Rounds {
+		if round.Date.IsZero() {
+			problems = append(problems, fmt.Sprintf("Round %d: date should be set", i+1))
+		}
+		seen := make(map[string]bool)
+		for j, g := range round.Groups {
+			if len(g) == 0 {
+				problems = append(problems, fmt.Sprintf("Round %d: group %d is empty", i+1, j+1))
+			}
+			for _, user := range g {
+				if user == "" {
+					problems = append(problems, fmt.Sprintf("Round %d: group %d has an empty user", i+1, j+1))
+				} else if seen[user] {
+					problems = append(problems, fmt.Sprintf("Round %d: %s is in more than one place", i+1, user))
+				}
+				seen[user] = true
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New("Invalid history!\n" + strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// ResolveUsers replaces user names in data with the IDs of users. Users
+// matching neither an ID nor a unique name are kept and returned as unknown.
+func ResolveUsers(data Data, users []ct.User) (Data, []string) {
+	known := make(map[string]string)
+	shared := make(map[string]bool)
+	for _, u := range users {
+		if _, ok := known[u.Name]; ok && known[u.Name] != u.ID {
+			shared[u.Name] = true
+		}
+		known[u.Name] = u.ID
+	}
+	for _, u := range users {
+		known[u.ID] = u.ID
+	}
+	unknown := make(map[string]bool)
+	resolve := func(user string) string {
+		if id, ok := known[user]; ok && !shared[user] {
+			return id
+		}
+		unknown[user] = true
+		return user
+	}
+	resolved := Data{}
+	for _, rel := range data.Relations {
+		rel.User1, rel.User2 = resolve(rel.User1), resolve(rel.User2)
+		resolved.Relations = append(resolved.Relations, rel)
+	}
+	for _, round := range data.Rounds {
+		groups := make([][]string, len(round.Groups))
+		for i, g := range round.Groups {
+			for _, user := range g {
+				groups[i] = append(groups[i], resolve(user))
+			}
+		}
+		round.Groups = groups
+		resolved.Rounds = append(resolved.Rounds, round)
+	}
+	names := []string{}
+	for user := range unknown {
+		names = append(names, user)
+	}
+	sort.Strings(names)
+	return resolved, names
+}
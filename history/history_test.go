@@ -0,0 +1,216 @@
+package history
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ct "github.com/mtyurt/coffeetable"
+	"github.com/mtyurt/coffeetable/repo"
+)
+
+func testData() Data {
+	date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	return Data{
+		Relations: []ct.UserRelation{
+			ct.UserRelation{User1: "U1", User2: "U2", Encounters: 3},
+			ct.UserRelation{User1: "U3", User2: "U1", Encounters: 1},
+		},
+		Rounds: []ct.Round{
+			ct.Round{Date: date, Channel: "coffee", Strategy: "random", Seed: 7, Groups: [][]string{[]string{"U1", "U2"}, []string{"U3", "U4", "U5"}}},
+			ct.Round{Date: date.Add(7 * 24 * time.Hour), Channel: "coffee", Strategy: "optimize", Seed: 8, Groups: [][]string{[]string{"U2", "U3"}}},
+		},
+	}
+}
+
+func TestWriteAndReadShouldRoundTrip(t *testing.T) {
+	data := testData()
+	for _, format := range []string{FORMAT_CSV, FORMAT_JSON} {
+		for _, kind := range []string{KIND_RELATIONS, KIND_ROUNDS} {
+			buf := bytes.Buffer{}
+			if err := Write(&buf, kind, format, data); err != nil {
+				t.Fatal(err)
+			}
+			read, err := Read(&buf, kind, format)
+			if err != nil {
+				t.Fatalf("%s %s: %v", kind, format, err)
+			}
+			if kind == KIND_RELATIONS && !reflect.DeepEqual(read.Relations, data.Relations) {
+				t.Fatalf("%s, relations expected: %v but was: %v", format, data.Relations, read.Relations)
+			}
+			if kind == KIND_ROUNDS && !reflect.DeepEqual(read.Rounds, data.Rounds) {
+				t.Fatalf("%s, rounds expected: %v but was: %v", format, data.Rounds, read.Rounds)
+			}
+		}
+	}
+}
+func TestWriteRelationsCSV(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := Write(&buf, KIND_RELATIONS, FORMAT_CSV, testData()); err != nil {
+		t.Fatal(err)
+	}
+	expected := "user1,user2,encounters\nU1,U2,3\nU3,U1,1\n"
+	if buf.String() != expected {
+		t.Fatalf("Expected:\n%s but was:\n%s", expected, buf.String())
+	}
+}
+func TestReadShouldFailForInvalidInput(t *testing.T) {
+	testTable := []struct {
+		kind   string
+		format string
+		input  string
+	}{
+		{KIND_RELATIONS, FORMAT_CSV, "a,b,c\nali,veli,1\n"},
+		{KIND_RELATIONS, FORMAT_CSV, "user1,user2,encounters\nali,veli,many\n"},
+		{KIND_RELATIONS, FORMAT_CSV, "user1,user2,encounters\nali,ali,1\n"},
+		{KIND_RELATIONS, FORMAT_JSON, `[{"user1":"ali","user2":"veli","encounters":-1}]`},
+		{KIND_ROUNDS, FORMAT_CSV, "date,channel,strategy,seed,group,user\nyesterday,coffee,random,1,1,ali\n"},
+		{KIND_ROUNDS, FORMAT_CSV, "date,channel,strategy,seed,group,user\n2019-10-18T10:00:00Z,coffee,random,1,0,ali\n"},
+		{KIND_ROUNDS, FORMAT_JSON, `[{"date":"2019-10-18T10:00:00Z","groups":[["ali","veli"],["ali"]]}]`},
+		{KIND_ROUNDS, FORMAT_JSON, `[{"groups":[["ali","veli"]]}]`},
+		{"pairs", FORMAT_JSON, `[]`},
+		{KIND_ROUNDS, "xml", `[]`},
+	}
+	for _, test := range testTable {
+		if _, err := Read(strings.NewReader(test.input), test.kind, test.format); err == nil {
+			t.Errorf("%s %s should fail for: %s", test.kind, test.format, test.input)
+		}
+	}
+}
+func TestValidateShouldReportEveryProblem(t *testing.T) {
+	err := Validate(Data{Relations: []ct.UserRelation{
+		ct.UserRelation{User1: "ali", User2: ""},
+		ct.UserRelation{User1: "ali", User2: "ali"},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "Relation 1") || !strings.Contains(err.Error(), "Relation 2") {
+		t.Fatalf("Both relations should be reported, it was: %v", err)
+	}
+}
+func TestResolveUsers(t *testing.T) {
+	users := []ct.User{
+		ct.User{ID: "U1", Name: "ali"},
+		ct.User{ID: "U2", Name: "veli"},
+		ct.User{ID: "U3", Name: "can"},
+		ct.User{ID: "U4", Name: "can"},
+	}
+	data := Data{
+		Relations: []ct.UserRelation{ct.UserRelation{User1: "ali", User2: "U2", Encounters: 1}, ct.UserRelation{User1: "can", User2: "tarik", Encounters: 1}},
+		Rounds:    []ct.Round{ct.Round{Groups: [][]string{[]string{"veli", "ali"}}}},
+	}
+	resolved, unknown := ResolveUsers(data, users)
+	expected := Data{
+		Relations: []ct.UserRelation{ct.UserRelation{User1: "U1", User2: "U2", Encounters: 1}, ct.UserRelation{User1: "can", User2: "tarik", Encounters: 1}},
+		Rounds:    []ct.Round{ct.Round{Groups: [][]string{[]string{"U2", "U1"}}}},
+	}
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Fatalf("Expected: %v but was: %v", expected, resolved)
+	}
+	if !reflect.DeepEqual(unknown, []string{"can", "tarik"}) {
+		t.Fatalf("Shared and missing names should be unknown, it was: %v", unknown)
+	}
+}
+func TestPlanAndApplyShouldMergeHistory(t *testing.T) {
+	r := repo.NewMemory()
+	scope := repo.ProgramScope("coffee")
+	if err := r.UpdateEncounters(scope, ct.UserRelation{User1: "U1", User2: "U2", Encounters: 2}); err != nil {
+		t.Fatal(err)
+	}
+	data := testData()
+	if err := r.SaveRound(scope, &data.Rounds[1]); err != nil {
+		t.Fatal(err)
+	}
+	data.Relations = append(data.Relations, ct.UserRelation{User1: "U2", User2: "U1", Encounters: 1})
+
+	report, err := Plan(r, scope, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// U1 and U2 met 4 times in the imported history and once in the imported
+	// round, the stored 2 encounters and the round make 3
+	expected := []RelationChange{RelationChange{"U1", "U2", 2, 4}, RelationChange{"U1", "U3", 0, 1}}
+	if !reflect.DeepEqual(report.Relations, expected) {
+		t.Fatalf("Relation changes expected: %v but was: %v", expected, report.Relations)
+	}
+	if len(report.Rounds) != 1 || len(report.SkippedRounds) != 1 || report.SkippedRounds[0].Seed != 8 {
+		t.Fatalf("The stored round should be skipped, report: %v", report)
+	}
+	if relations, _ := r.GetUserRelations(scope); len(relations) != 2 {
+		t.Fatalf("Plan should not change the repo, relations: %v", relations)
+	}
+
+	if err := Apply(r, scope, report); err != nil {
+		t.Fatal(err)
+	}
+	relations, err := r.GetUserRelations(scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encounters := make(map[string]int)
+	for _, rel := range relations {
+		encounters[rel.User1+"|"+rel.User2] = rel.Encounters
+	}
+	if encounters["U1|U2"] != 4 || encounters["U1|U3"] != 1 || encounters["U3|U4"] != 1 {
+		t.Fatalf("Imported history should be merged, it was: %v", encounters)
+	}
+	if rounds, _ := r.GetRounds(scope); len(rounds) != 2 {
+		t.Fatalf("2 rounds expected but was: %v", rounds)
+	}
+}
+func TestExportAndImportShouldRoundTrip(t *testing.T) {
+	source := repo.NewMemory()
+	scope := repo.ProgramScope("coffee")
+	if err := source.UpdateEncounters(scope, ct.UserRelation{User1: "U1", User2: "U2", Encounters: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, round := range testData().Rounds {
+		if err := source.SaveRound(scope, &round); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exported, err := Export(source, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := repo.NewMemory()
+	for _, r := range []repo.Repo{target, target, source} {
+		for _, kind := range []string{KIND_ROUNDS, KIND_RELATIONS} {
+			buf := bytes.Buffer{}
+			if err := Write(&buf, kind, FORMAT_JSON, exported); err != nil {
+				t.Fatal(err)
+			}
+			data, err := Read(&buf, kind, FORMAT_JSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := Plan(r, scope, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := Apply(r, scope, report); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// importing twice, or into the exporting repo, counts every encounter once
+	for _, r := range []repo.Repo{target, source} {
+		imported, err := Export(r, scope)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(relationCounts(imported.Relations), relationCounts(exported.Relations)) {
+			t.Fatalf("Relations expected: %v but was: %v", exported.Relations, imported.Relations)
+		}
+		if len(imported.Rounds) != len(exported.Rounds) {
+			t.Fatalf("Rounds expected: %v but was: %v", exported.Rounds, imported.Rounds)
+		}
+	}
+}
+func relationCounts(relations []ct.UserRelation) map[string]int {
+	counts := make(map[string]int)
+	for _, rel := range relations {
+		counts[pairKey(rel.User1, rel.User2)] += rel.Encounters
+	}
+	return counts
+}
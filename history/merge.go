@@ -0,0 +1,149 @@
+package history
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	ct "github.com/mtyurt/coffeetable"
+	"github.com/mtyurt/coffeetable/repo"
+)
+
+// RelationChange is the encounters of a pair before and after an import.
+type RelationChange struct {
+	User1 string
+	User2 string
+	From  int
+	To    int
+}
+
+// Report is what an import changes. Imported rounds are saved like
+// published rounds, counting an encounter for each of their pairs, unless a
+// round of the same channel and date is already stored and not rolled back.
+// Imported relations are totals, like exported ones, and already cover the
+// rounds they were exported with: a pair ends up with the larger of its
+// stored encounters, new rounds included, and its imported encounters. So
+// importing the same history twice, or both its relations and its rounds,
+// counts every encounter once.
+type Report struct {
+	Relations     []RelationChange
+	Rounds        []ct.Round
+	SkippedRounds []ct.Round
+	UnknownUsers  []string
+}
+
+func (r Report) String() string {
+	b := strings.Builder{}
+	added, updated, unchanged := 0, 0, 0
+	for _, c := range r.Relations {
+		switch {
+		case c.To == c.From:
+			unchanged++
+		case c.From == 0:
+			added++
+		default:
+			updated++
+		}
+	}
+	fmt.Fprintf(&b, "Relations: %d new, %d updated, %d unchanged\n", added, updated, unchanged)
+	for _, c := range r.Relations {
+		if c.To != c.From {
+			fmt.Fprintf(&b, "  %s %s: %d -> %d\n", c.User1, c.User2, c.From, c.To)
+		}
+	}
+	fmt.Fprintf(&b, "Rounds: %d new, %d already stored\n", len(r.Rounds), len(r.SkippedRounds))
+	for _, round := range r.Rounds {
+		fmt.Fprintf(&b, "  %s #%s: %d groups\n", round.Date.Format(time.RFC3339), round.Channel, len(round.Groups))
+	}
+	if len(r.UnknownUsers) > 0 {
+		fmt.Fprintf(&b, "Users not in the channel: %s\n", strings.Join(r.UnknownUsers, ", "))
+	}
+	return b.String()
+}
+
+// Plan validates data and reports what importing it into a program of r
+// would change, without changing anything.
+func Plan(r repo.Repo, scope repo.Scope, data Data) (Report, error) {
+	report := Report{}
+	if err := Validate(data); err != nil {
+		return report, err
+	}
+	stored, err := r.GetUserRelations(scope)
+	if err != nil {
+		return report, err
+	}
+	encounters := make(map[string]int)
+	for _, rel := range stored {
+		encounters[pairKey(rel.User1, rel.User2)] += rel.Encounters
+	}
+	rounds, err := r.GetRounds(scope)
+	if err != nil {
+		return report, err
+	}
+	saved := make(map[string]bool)
+	for _, round := range rounds {
+		if !round.Reverted {
+			saved[roundKey(round)] = true
+		}
+	}
+	for _, round := range data.Rounds {
+		if saved[roundKey(round)] {
+			report.SkippedRounds = append(report.SkippedRounds, round)
+		} else {
+			saved[roundKey(round)] = true
+			report.Rounds = append(report.Rounds, round)
+		}
+	}
+
+	withRounds := make(map[string]int)
+	for k, n := range encounters {
+		withRounds[k] = n
+	}
+	for _, round := range report.Rounds {
+		for _, e := range round.Encounters() {
+			withRounds[pairKey(e.User1, e.User2)]++
+		}
+	}
+	imported := make(map[string]int)
+	for _, rel := range data.Relations {
+		key := pairKey(rel.User1, rel.User2)
+		if _, ok := imported[key]; !ok {
+			user1, user2 := canonicalPair(rel.User1, rel.User2)
+			report.Relations = append(report.Relations, RelationChange{User1: user1, User2: user2, From: encounters[key]})
+		}
+		imported[key] += rel.Encounters
+	}
+	for i, c := range report.Relations {
+		key := pairKey(c.User1, c.User2)
+		report.Relations[i].To = withRounds[key]
+		if imported[key] > withRounds[key] {
+			report.Relations[i].To = imported[key]
+		}
+	}
+	return report, nil
+}
+
+// Apply makes the changes of a report made by Plan at once, so a failing
+// import changes nothing.
+func Apply(r repo.Repo, scope repo.Scope, report Report) error {
+	relations := []ct.UserRelation{}
+	for _, c := range report.Relations {
+		relations = append(relations, ct.UserRelation{User1: c.User1, User2: c.User2, Encounters: c.To})
+	}
+	rounds := append([]ct.Round{}, report.Rounds...)
+	return r.MergeHistory(scope, rounds, relations)
+}
+
+func canonicalPair(user1 string, user2 string) (string, string) {
+	if user2 < user1 {
+		return user2, user1
+	}
+	return user1, user2
+}
+func pairKey(user1 string, user2 string) string {
+	user1, user2 = canonicalPair(user1, user2)
+	return user1 + "|" + user2
+}
+func roundKey(round ct.Round) string {
+	return round.Date.UTC().Format(time.RFC3339Nano) + "|" + round.Channel
+}
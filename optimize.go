@@ -0,0 +1,145 @@
+package coffeetable
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const DEFAULT_ITERATIONS = 20000
+
+// OptimizeGroups starts from a random partition and keeps swapping members
+// between groups, simulated annealing style, to minimize the total number of
+// repeat encounters inside all groups. It stops after opts.Iterations swaps
+// or when opts.TimeBudget is exhausted, whichever comes first. Apart
+// violations count as a huge number of encounters, pinned users and users
+// who must be together are never swapped.
+func OptimizeGroups(relations []UserRelation, users []User, opts Options) ([][]User, []UserRelation, error) {
+	groups, relations, _, err := optimizeGroups(relations, users, opts)
+	return groups, relations, err
+}
+
+// optimizeGroups is OptimizeGroups also returning the rounds of cooldown the
+// groups respect, see withCooldown.
+func optimizeGroups(relations []UserRelation, users []User, opts Options) ([][]User, []UserRelation, int, error) {
+	groupSizes, err := generateGroupSizesWithOptions(len(users), opts)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	encounters := weightedEncounterMap(relations, opts)
+	groups, cooldown, err := withCooldown(opts, func(constraints constraintSet) ([][]User, error) {
+		rnd := rand.New(rand.NewSource(opts.Seed))
+		p, err := constraints.place(users, groupSizes)
+		if err != nil {
+			return nil, err
+		}
+		groups, err := generateGroups(rnd, sortUsers(users), groupSizes, map[string]int{}, constraints)
+		if err != nil {
+			return nil, err
+		}
+		groups = anneal(rnd, groups, constraints.penalize(encounters), float64(maxEncounter(encounters))+1, p.fixed(), opts)
+		if !constraints.satisfiedBy(groups) {
+			return nil, ErrConstraintsUnsatisfiable
+		}
+		return groups, nil
+	})
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return groups, recordGroups(relations, groups), cooldown, nil
+}
+
+func TotalEncounters(groups [][]User, relations []UserRelation) int {
+	return totalEncounters(groups, encounterMap(relations))
+}
+
+func totalEncounters(groups [][]User, encounters map[string]int) int {
+	total := 0
+	for _, g := range groups {
+		total += groupEncounters(g, encounters)
+	}
+	return total
+}
+
+func anneal(rnd *rand.Rand, groups [][]User, encounters map[string]int, startTemperature float64, fixed map[string]bool, opts Options) [][]User {
+	current := copyGroups(groups)
+	best := copyGroups(groups)
+	cost := totalEncounters(current, encounters)
+	bestCost := cost
+	if len(current) < 2 || cost == 0 {
+		return best
+	}
+	iterations := opts.Iterations
+	if iterations <= 0 {
+		iterations = DEFAULT_ITERATIONS
+	}
+	var deadline time.Time
+	if opts.TimeBudget > 0 {
+		deadline = time.Now().Add(opts.TimeBudget)
+	}
+	for i := 0; i < iterations && bestCost > 0; i++ {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			break
+		}
+		g1 := rnd.Intn(len(current))
+		g2 := rnd.Intn(len(current) - 1)
+		if g2 >= g1 {
+			g2++
+		}
+		m1 := rnd.Intn(len(current[g1]))
+		m2 := rnd.Intn(len(current[g2]))
+		if fixed[current[g1][m1].ID] || fixed[current[g2][m2].ID] {
+			continue
+		}
+		delta := swapDelta(current[g1], m1, current[g2], m2, encounters)
+		temperature := startTemperature * (1 - float64(i)/float64(iterations))
+		if delta > 0 && rnd.Float64() >= math.Exp(-float64(delta)/temperature) {
+			continue
+		}
+		current[g1][m1], current[g2][m2] = current[g2][m2], current[g1][m1]
+		cost += delta
+		if cost < bestCost {
+			bestCost = cost
+			best = copyGroups(current)
+		}
+	}
+	return best
+}
+
+// swapDelta returns how the total encounters change when the m1th member of
+// g1 and the m2th member of g2 trade places.
+func swapDelta(g1 []User, m1 int, g2 []User, m2 int, encounters map[string]int) int {
+	u1 := g1[m1]
+	u2 := g2[m2]
+	delta := 0
+	for i, u := range g1 {
+		if i != m1 {
+			delta += encounters[u2.ID+"|"+u.ID] - encounters[u1.ID+"|"+u.ID]
+		}
+	}
+	for i, u := range g2 {
+		if i != m2 {
+			delta += encounters[u1.ID+"|"+u.ID] - encounters[u2.ID+"|"+u.ID]
+		}
+	}
+	return delta
+}
+
+func maxEncounter(encounters map[string]int) int {
+	max := 0
+	for _, e := range encounters {
+		if e > max {
+			max = e
+		}
+	}
+	return max
+}
+
+func copyGroups(groups [][]User) [][]User {
+	dest := make([][]User, len(groups))
+	for i, g := range groups {
+		dest[i] = make([]User, len(g))
+		copy(dest[i], g)
+	}
+	return dest
+}
@@ -0,0 +1,104 @@
+package coffeetable
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOptimizeGroupsShouldAvoidRepeatEncounters(t *testing.T) {
+	inputUsers := []User{slackUser("tarik"), slackUser("ali"), slackUser("veli"), slackUser("deli"), slackUser("can"), slackUser("cem")}
+	inputRelations := []UserRelation{
+		UserRelation{User1: "tarik", User2: "ali", Encounters: 4},
+		UserRelation{User1: "veli", User2: "deli", Encounters: 3},
+		UserRelation{User1: "can", User2: "cem", Encounters: 5},
+		UserRelation{User1: "tarik", User2: "veli", Encounters: 1},
+	}
+	opts := sizeOptions(2, 2, 2)
+	for seed := int64(1); seed <= 5; seed++ {
+		opts.Seed = seed
+		groups, relations, err := OptimizeGroups(inputRelations, inputUsers, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != 3 {
+			t.Fatalf("3 pairs expected but it was: %v", userGroupNames(groups))
+		}
+		if total := TotalEncounters(groups, inputRelations); total != 0 {
+			t.Fatalf("Seed %d, no repeat encounters expected but it was %d in: %v", seed, total, userGroupNames(groups))
+		}
+		if len(relations) != 7 {
+			t.Fatalf("Relations length is wrong, 7 relations is expected but it was %d relations: %v", len(relations), relations)
+		}
+	}
+}
+
+func TestOptimizeGroupsShouldBeReproducibleWithSameSeed(t *testing.T) {
+	inputUsers := []User{slackUser("tarik"), slackUser("ali"), slackUser("veli"), slackUser("deli"), slackUser("can"), slackUser("cem"), slackUser("naz")}
+	inputRelations := []UserRelation{
+		UserRelation{User1: "tarik", User2: "ali", Encounters: 2},
+		UserRelation{User1: "tarik", User2: "veli", Encounters: 2},
+		UserRelation{User1: "ali", User2: "veli", Encounters: 2},
+		UserRelation{User1: "can", User2: "naz", Encounters: 1},
+	}
+	opts := DefaultOptions()
+	opts.Seed = 7
+	expected, _, err := OptimizeGroups(inputRelations, inputUsers, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, _, err := OptimizeGroups(inputRelations, inputUsers, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(userGroupNames(actual), userGroupNames(expected)) {
+		t.Fatalf("Expected groups: %v but was: %v", userGroupNames(expected), userGroupNames(actual))
+	}
+}
+
+func TestOptimizeGroupsShouldRespectTimeBudget(t *testing.T) {
+	inputUsers := []User{}
+	inputRelations := []UserRelation{}
+	for _, n := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"} {
+		for _, u := range inputUsers {
+			inputRelations = append(inputRelations, UserRelation{User1: u.Name, User2: n, Encounters: 1})
+		}
+		inputUsers = append(inputUsers, slackUser(n))
+	}
+	opts := DefaultOptions()
+	opts.Iterations = 1 << 30
+	opts.TimeBudget = 50 * time.Millisecond
+	start := time.Now()
+	groups, _, err := OptimizeGroups(inputRelations, inputUsers, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Time budget is not respected, it took: %v", elapsed)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("3 groups expected but it was: %v", userGroupNames(groups))
+	}
+}
+
+func TestOptimizeGroupsShouldFailWhenBoundsCannotBeMet(t *testing.T) {
+	if _, _, err := OptimizeGroups([]UserRelation{}, []User{slackUser("ali"), slackUser("veli"), slackUser("deli")}, sizeOptions(2, 2, 2)); err == nil {
+		t.Fatal("Error expected when 3 users cannot be paired")
+	}
+}
+
+func TestSwapDelta(t *testing.T) {
+	encounters := encounterMap([]UserRelation{
+		UserRelation{User1: "tarik", User2: "ali", Encounters: 4},
+		UserRelation{User1: "veli", User2: "deli", Encounters: 3},
+		UserRelation{User1: "tarik", User2: "deli", Encounters: 1},
+	})
+	g1 := []User{slackUser("tarik"), slackUser("ali")}
+	g2 := []User{slackUser("veli"), slackUser("deli")}
+	if delta := swapDelta(g1, 1, g2, 0, encounters); delta != -7 {
+		t.Fatalf("Swapping ali and veli should remove 7 encounters, delta was: %d", delta)
+	}
+	if delta := swapDelta(g1, 0, g2, 0, encounters); delta != -6 {
+		t.Fatalf("Swapping tarik and veli should remove 7 and add 1 encounters, delta was: %d", delta)
+	}
+}
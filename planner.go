@@ -0,0 +1,85 @@
+package coffeetable
+
+import (
+	"fmt"
+	"time"
+)
+
+const PLAN_ATTEMPTS = 10
+
+// PLAN_INTERVAL is the time between planned rounds.
+const PLAN_INTERVAL = 7 * 24 * time.Hour
+
+// PlannedRound is a round of a multi-round plan. Relations are the relations
+// after the round, to be persisted only when the round is published. Seed
+// reproduces the round with the grouper of the plan at Date. Cooldown is the
+// rounds of cooldown the groups respect, see CooldownGrouper, all of
+// Options.CooldownRounds for a grouper without one.
+type PlannedRound struct {
+	Date      time.Time
+	Seed      int64
+	Groups    [][]User
+	Relations []UserRelation
+	Cooldown  int
+}
+
+// PlanRounds generates the next rounds at once with the grouper of strategy,
+// each round builds on the relations of the rounds before it. For every
+// round a few seeds are tried and the groups with the fewest repeat
+// encounters are kept, the optimize and round robin strategies make a single
+// attempt since they search or need no seed. Round robin rounds carry on
+// from schedule, which is left as it is. The first round is held at opts.Now
+// and every next one PLAN_INTERVAL later, so the cooldown tells planned
+// rounds apart.
+func PlanRounds(relations []UserRelation, users []User, rounds int, strategy string, schedule CircleSchedule, opts Options) ([]PlannedRound, error) {
+	if rounds < 1 {
+		return nil, fmt.Errorf("Round count must be positive, it was: %d", rounds)
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	attempts := PLAN_ATTEMPTS
+	if strategy == STRATEGY_OPTIMIZE || strategy == STRATEGY_ROUNDROBIN {
+		attempts = 1
+	}
+	opts.Encounters = append([]Encounter{}, opts.Encounters...)
+	plan := make([]PlannedRound, rounds)
+	for i := range plan {
+		best := -1
+		bestSchedule := schedule
+		for a := 0; a < attempts; a++ {
+			roundOpts := opts
+			roundOpts.Now = opts.Now.Add(time.Duration(i) * PLAN_INTERVAL)
+			roundOpts.Seed = opts.Seed + int64(i*PLAN_ATTEMPTS+a)
+			grouper, err := NewGrouper(strategy, roundOpts)
+			if err != nil {
+				return nil, err
+			}
+			roundSchedule := CircleSchedule{Seats: append([]string{}, schedule.Seats...), Round: schedule.Round}
+			if roundRobin, ok := grouper.(*RoundRobinGrouper); ok {
+				roundRobin.Schedule = &roundSchedule
+			}
+			groups, newRelations, err := grouper.Group(relations, users)
+			if err != nil {
+				return nil, err
+			}
+			cooldown := opts.CooldownRounds
+			if cooldownGrouper, ok := grouper.(CooldownGrouper); ok {
+				cooldown = cooldownGrouper.Cooldown()
+			}
+			repeats := TotalEncounters(groups, relations)
+			if best < 0 || repeats < best {
+				best = repeats
+				bestSchedule = roundSchedule
+				plan[i] = PlannedRound{roundOpts.Now, roundOpts.Seed, groups, newRelations, cooldown}
+			}
+			if repeats == 0 {
+				break
+			}
+		}
+		relations = plan[i].Relations
+		schedule = bestSchedule
+		opts.Encounters = append(opts.Encounters, NewEncounters(plan[i].Groups, plan[i].Date)...)
+	}
+	return plan, nil
+}
@@ -0,0 +1,93 @@
+package coffeetable
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanRounds(t *testing.T) {
+	inputUsers := namedUsers(8)
+	inputRelations := []UserRelation{UserRelation{User1: "u0", User2: "u1", Encounters: 3}}
+	opts := sizeOptions(2, 2, 2)
+	opts.Seed = 3
+	plan, err := PlanRounds(inputRelations, inputUsers, 4, STRATEGY_WEIGHTED, CircleSchedule{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 4 {
+		t.Fatalf("4 rounds expected but it was: %d", len(plan))
+	}
+	relations := inputRelations
+	for i, round := range plan {
+		if len(round.Groups) != 4 {
+			t.Fatalf("Round %d, 4 pairs expected but it was: %v", i, userGroupNames(round.Groups))
+		}
+		if repeats := TotalEncounters(round.Groups, relations); repeats != 0 {
+			t.Errorf("Round %d, no repeat encounters expected but it was %d in: %v", i, repeats, userGroupNames(round.Groups))
+		}
+		expectedRelations := recordGroups(relations, round.Groups)
+		if !reflect.DeepEqual(round.Relations, expectedRelations) {
+			t.Fatalf("Round %d, relations expected: %v but was: %v", i, expectedRelations, round.Relations)
+		}
+		roundOpts := opts
+		roundOpts.Seed = round.Seed
+		groups, _, err := GenerateGroupsWithOptions(relations, inputUsers, roundOpts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(userGroupNames(groups), userGroupNames(round.Groups)) {
+			t.Fatalf("Round %d should be reproducible from its seed, expected: %v but was: %v", i, userGroupNames(round.Groups), userGroupNames(groups))
+		}
+		relations = round.Relations
+	}
+	if len(inputRelations) != 1 || inputRelations[0].Encounters != 3 {
+		t.Fatalf("Input relations should not be modified: %v", inputRelations)
+	}
+}
+
+func TestPlanRoundsShouldFailForInvalidInput(t *testing.T) {
+	if _, err := PlanRounds([]UserRelation{}, namedUsers(4), 0, STRATEGY_WEIGHTED, CircleSchedule{}, DefaultOptions()); err == nil {
+		t.Fatal("Error expected for zero rounds")
+	}
+	if _, err := PlanRounds([]UserRelation{}, namedUsers(3), 2, STRATEGY_WEIGHTED, CircleSchedule{}, sizeOptions(2, 2, 2)); err == nil {
+		t.Fatal("Error expected when 3 users cannot be paired")
+	}
+}
+func TestPlanRoundsShouldDateRoundsApartForCooldown(t *testing.T) {
+	opts := sizeOptions(2, 2, 2)
+	opts.Now = time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	opts.CooldownRounds = 1
+	plan, err := PlanRounds([]UserRelation{}, namedUsers(4), 4, STRATEGY_WEIGHTED, CircleSchedule{}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, round := range plan {
+		if date := opts.Now.Add(time.Duration(i) * PLAN_INTERVAL); !round.Date.Equal(date) {
+			t.Fatalf("Round %d, date expected: %v but was: %v", i, date, round.Date)
+		}
+		// 4 users have 3 disjoint pairings, rounds sharing a date would count
+		// as one and leave the fourth round without a pairing
+		if round.Cooldown != 1 {
+			t.Fatalf("Round %d, cooldown should not be relaxed but was: %d", i, round.Cooldown)
+		}
+	}
+}
+func TestPlanRoundsShouldCarryOnTheRoundRobinSchedule(t *testing.T) {
+	users := namedUsers(4)
+	schedule := CircleSchedule{Seats: []string{"u0", "u1", "u2", "u3"}, Round: 1}
+	plan, err := PlanRounds([]UserRelation{}, users, 3, STRATEGY_ROUNDROBIN, schedule, sizeOptions(2, 2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CircleSchedule{Seats: []string{"u0", "u1", "u2", "u3"}, Round: 1}
+	for i, round := range plan {
+		groups := expected.Next(users)
+		if !reflect.DeepEqual(userGroupNames(round.Groups), userGroupNames(groups)) {
+			t.Fatalf("Round %d, round robin groups expected: %v but was: %v", i, userGroupNames(groups), userGroupNames(round.Groups))
+		}
+	}
+	if schedule.Round != 1 || !reflect.DeepEqual(schedule.Seats, []string{"u0", "u1", "u2", "u3"}) {
+		t.Fatalf("Schedule should be left as it is but was: %v", schedule)
+	}
+}
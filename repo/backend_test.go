@@ -0,0 +1,483 @@
+package repo
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	ct "github.com/mtyurt/coffeetable"
+)
+
+// POSTGRES_DSN_ENV names the DSN of a throwaway Postgres database, its
+// tables are dropped by the tests. Postgres tests are skipped without it.
+const POSTGRES_DSN_ENV = "COFFEETABLE_POSTGRES_DSN"
+
+func TestSQLiteBackend(t *testing.T) {
+	db, err := sql.Open(DRIVER_SQLITE, filepath.Join(t.TempDir(), "coffeetable.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testBackend(t, DRIVER_SQLITE, db)
+}
+func TestPostgresBackend(t *testing.T) {
+	dsn := os.Getenv(POSTGRES_DSN_ENV)
+	if dsn == "" {
+		t.Skip(POSTGRES_DSN_ENV + " is not set")
+	}
+	db, err := sql.Open(DRIVER_POSTGRES, dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, table := range []string{"schema_version", "user_relation", "circle_schedule", "user_constraint", "encounter", "migration", "round_members", "rounds", "run_lock", "user_cache"} {
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + table + " CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testBackend(t, DRIVER_POSTGRES, db)
+}
+
+func TestMemoryRepo(t *testing.T) {
+	testRepo(t, NewMemory())
+}
+func TestJSONFileRepo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coffeetable.json")
+	r, err := NewJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRepo(t, r)
+
+	reopened, err := NewJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, check := range []func(Repo) (interface{}, error){
+		func(r Repo) (interface{}, error) { return r.GetUserRelations(coffee) },
+		func(r Repo) (interface{}, error) { return r.GetRounds(coffee) },
+		func(r Repo) (interface{}, error) { return r.GetEncounters(coffee) },
+		func(r Repo) (interface{}, error) { return r.GetSchedule(coffee) },
+		func(r Repo) (interface{}, error) { return r.GetConstraints(coffee) },
+		func(r Repo) (interface{}, error) {
+			users, fetchedAt, err := r.GetUserCache()
+			return []interface{}{users, fetchedAt}, err
+		},
+	} {
+		expected, err1 := check(r)
+		actual, err2 := check(reopened)
+		if err1 != nil || err2 != nil || !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("Reopened file should have: %v but had: %v errors: %v %v", expected, actual, err1, err2)
+		}
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(content), `"users"`) {
+		t.Fatalf("User cache should be kept out of the history file: %s", content)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(path), "coffeetable.users.json")); err != nil {
+		t.Fatalf("User cache file should be written, error: %v", err)
+	}
+}
+func TestJSONFileRepoShouldKeepItsStateWhenTheFileFailsToLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coffeetable.json")
+	r, err := NewJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddConstraint(coffee, ct.Constraint{Kind: ct.CONSTRAINT_PIN, User1: "ali", Group: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddConstraint(coffee, ct.Constraint{Kind: ct.CONSTRAINT_PIN, User1: "veli", Group: 2}); err == nil {
+		t.Fatal("A change should fail when the file fails to load")
+	}
+	if constraints, err := r.GetConstraints(coffee); err != nil || len(constraints) != 1 {
+		t.Fatalf("The state before the failing change expected but was: %v error: %v", constraints, err)
+	}
+}
+func TestJSONFileRepoShouldKeepChangesOfAnotherProcess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coffeetable.json")
+	r1, err := NewJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := NewJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r1.AddConstraint(coffee, ct.Constraint{Kind: ct.CONSTRAINT_PIN, User1: "ali", Group: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// another process holds the lock for a while
+	if err := ioutil.WriteFile(path+".lock", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.Remove(path + ".lock")
+	}()
+	if err := r2.AddConstraint(coffee, ct.Constraint{Kind: ct.CONSTRAINT_PIN, User1: "veli", Group: 2}); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := reopened.GetConstraints(coffee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 || saved[0].User1 != "ali" || saved[1].User1 != "veli" || saved[0].ID == saved[1].ID {
+		t.Fatalf("Constraints of both processes expected but was: %v", saved)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Fatalf("Lock file should be removed, error: %v", err)
+	}
+}
+
+func testBackend(t *testing.T, driver string, db *sql.DB) {
+	applied, err := Migrate(db, driver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) == 0 {
+		t.Fatal("Migrations should be applied to an empty database")
+	}
+	if applied, err = Migrate(db, driver); err != nil || len(applied) != 0 {
+		t.Fatalf("Migrations should be applied once, applied: %v error: %v", applied, err)
+	}
+	r, err := NewWithDriver(driver, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRepo(t, r)
+}
+
+// testRepo runs the same scenario on every Repo implementation.
+func testRepo(t *testing.T, r Repo) {
+	if err := r.UpdateEncounters(coffee, userRelation("veli", "ali", 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateEncounters(coffee, userRelation("ali", "veli", 3)); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	round := ct.Round{Date: date, Channel: "coffee", Strategy: "random", Seed: 1571400000000000000, Groups: [][]string{[]string{"veli", "ali"}, []string{"can", "cem", "deli"}}}
+	if err := r.SaveRound(coffee, &round); err != nil {
+		t.Fatal(err)
+	}
+	relations, err := r.GetUserRelations(coffee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encounters := make(map[string]int)
+	for _, rel := range relations {
+		encounters[rel.User1+"|"+rel.User2] = rel.Encounters
+	}
+	expected := map[string]int{"ali|veli": 4, "can|cem": 1, "can|deli": 1, "cem|deli": 1}
+	if !reflect.DeepEqual(encounters, expected) {
+		t.Fatalf("Relations expected: %v but was: %v", expected, encounters)
+	}
+
+	// a date off UTC reads back the same from every backend
+	later := ct.Round{Date: date.Add(7 * 24 * time.Hour).In(time.FixedZone("TRT", 3*60*60)), Channel: "coffee", Strategy: "optimize", Seed: 2, Groups: [][]string{[]string{"ali", "can"}}}
+	if err := r.SaveRound(coffee, &later); err != nil {
+		t.Fatal(err)
+	}
+	rounds, err := r.GetRounds(coffee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rounds) != 2 || rounds[0].ID != later.ID || rounds[1].ID != round.ID {
+		t.Fatalf("Rounds %d and %d expected latest first but was: %v", later.ID, round.ID, rounds)
+	}
+	if !rounds[0].Date.Equal(later.Date) || !rounds[1].Date.Equal(date) || rounds[1].Seed != round.Seed || !reflect.DeepEqual(rounds[1].Groups, round.Groups) {
+		t.Fatalf("Round expected: %v but was: %v", round, rounds[1])
+	}
+	all, err := r.GetEncounters(coffee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 {
+		t.Fatalf("5 encounters expected but was: %v", all)
+	}
+	recent, err := r.GetRecentEncounters(coffee, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recent) != 1 || recent[0].User1 != "ali" || recent[0].User2 != "can" {
+		t.Fatalf("Encounters of the last round expected but was: %v", recent)
+	}
+
+	// lunch keeps its own rounds but shares the history of coffee, tea keeps
+	// both apart
+	lunch := Scope{Program: "lunch", History: "coffee"}
+	tea := ProgramScope("tea")
+	lunchRound := ct.Round{Date: date.Add(time.Hour), Channel: "lunch", Strategy: "random", Seed: 3, Groups: [][]string{[]string{"cem", "veli"}}}
+	if err := r.SaveRound(lunch, &lunchRound); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SaveRound(tea, &ct.Round{Date: date, Channel: "tea", Strategy: "random", Seed: 4, Groups: [][]string{[]string{"ali", "veli"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if rounds, err = r.GetRounds(lunch); err != nil || len(rounds) != 1 || rounds[0].ID != lunchRound.ID {
+		t.Fatalf("Only the lunch round expected but was: %v error: %v", rounds, err)
+	}
+	if rounds, err = r.GetRounds(coffee); err != nil || len(rounds) != 2 {
+		t.Fatalf("Coffee rounds should not change but was: %v error: %v", rounds, err)
+	}
+	shared, err := r.GetUserRelations(coffee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, rel := range shared {
+		found = found || (rel.User1 == "cem" && rel.User2 == "veli")
+	}
+	if !found {
+		t.Fatalf("Lunch pair should be in the coffee history, relations: %v", shared)
+	}
+	teaRelations, err := r.GetUserRelations(tea)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(teaRelations) != 1 || teaRelations[0].Encounters != 1 {
+		t.Fatalf("Tea should keep its own history but was: %v", teaRelations)
+	}
+	if all, err = r.GetEncounters(tea); err != nil || len(all) != 1 {
+		t.Fatalf("1 tea encounter expected but was: %v error: %v", all, err)
+	}
+
+	if err := r.SetRoundMessage(lunch, lunchRound.ID, "1571400000.000200"); err != nil {
+		t.Fatal(err)
+	}
+	reverted, err := r.RevertRound(lunch, lunchRound.ID)
+	if err != nil || !reverted.Reverted || reverted.MessageTS != "1571400000.000200" {
+		t.Fatalf("Lunch round should be reverted but was: %v error: %v", reverted, err)
+	}
+	if _, err = r.RevertRound(lunch, lunchRound.ID); err == nil {
+		t.Fatal("A reverted round should not be reverted again")
+	}
+	if _, err = r.RevertRound(tea, lunchRound.ID); err == nil {
+		t.Fatal("A round of another program should not be reverted")
+	}
+	if shared, err = r.GetUserRelations(coffee); err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range shared {
+		if rel.User1 == "cem" && rel.User2 == "veli" && rel.Encounters != 0 {
+			t.Fatalf("Encounters of the reverted round should be taken back but was: %v", rel)
+		}
+	}
+	if all, err = r.GetEncounters(coffee); err != nil || len(all) != 5 {
+		t.Fatalf("5 encounters expected after the rollback but was: %v error: %v", all, err)
+	}
+	if rounds, err = r.GetRounds(lunch); err != nil || len(rounds) != 1 || !rounds[0].Reverted {
+		t.Fatalf("Lunch round should be marked reverted but was: %v error: %v", rounds, err)
+	}
+
+	now := date.Add(24 * time.Hour)
+	if acquired, err := r.AcquireRunLock(coffee, "host:1", now, time.Hour); err != nil || !acquired {
+		t.Fatalf("Lock should be acquired, error: %v", err)
+	}
+	if acquired, err := r.AcquireRunLock(coffee, "host:2", now.Add(time.Minute), time.Hour); err != nil || acquired {
+		t.Fatalf("Lock held by another owner should not be acquired, error: %v", err)
+	}
+	if acquired, err := r.AcquireRunLock(tea, "host:2", now, time.Hour); err != nil || !acquired {
+		t.Fatalf("Lock of another program should be acquired, error: %v", err)
+	}
+	if acquired, err := r.AcquireRunLock(coffee, "host:2", now.Add(2*time.Hour), time.Hour); err != nil || !acquired {
+		t.Fatalf("Expired lock should be acquired, error: %v", err)
+	}
+	if err := r.ReleaseRunLock(coffee, "host:2"); err != nil {
+		t.Fatal(err)
+	}
+	if acquired, err := r.AcquireRunLock(coffee, "host:1", now.Add(2*time.Hour), time.Hour); err != nil || !acquired {
+		t.Fatalf("Released lock should be acquired, error: %v", err)
+	}
+
+	keyed := ct.Round{Date: now, Channel: "tea", Strategy: "random", Seed: 5, Groups: [][]string{[]string{"can", "cem"}}, Key: ct.RunKey(now)}
+	if err := r.SaveRound(tea, &keyed); err != nil {
+		t.Fatal(err)
+	}
+	again := keyed
+	if err := r.SaveRound(tea, &again); err == nil {
+		t.Fatal("A second round with the same key should not be saved")
+	}
+	if _, err := r.RevertRound(tea, keyed.ID); err != nil {
+		t.Fatal(err)
+	}
+	again = keyed
+	if err := r.SaveRound(tea, &again); err != nil {
+		t.Fatalf("The key of a reverted round should be free, error: %v", err)
+	}
+
+	imported := ProgramScope("import")
+	importedRounds := []ct.Round{
+		ct.Round{Date: date, Channel: "import", Strategy: "random", Seed: 6, Groups: [][]string{[]string{"can", "cem"}}, Key: "a"},
+		ct.Round{Date: now, Channel: "import", Strategy: "random", Seed: 7, Groups: [][]string{[]string{"ali", "veli"}}, Key: "a"},
+	}
+	if err := r.MergeHistory(imported, importedRounds, []ct.UserRelation{userRelation("ali", "veli", 3)}); err == nil {
+		t.Fatal("Rounds with the same key should not be merged")
+	}
+	if rounds, err = r.GetRounds(imported); err != nil || len(rounds) != 0 {
+		t.Fatalf("A failing merge should save nothing but was: %v error: %v", rounds, err)
+	}
+	if relations, err = r.GetUserRelations(imported); err != nil || len(relations) != 0 {
+		t.Fatalf("A failing merge should save nothing but was: %v error: %v", relations, err)
+	}
+	importedRounds[1].Key = "b"
+	if err := r.MergeHistory(imported, importedRounds, []ct.UserRelation{userRelation("veli", "ali", 3), userRelation("can", "cem", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if importedRounds[0].ID == 0 || importedRounds[1].ID == 0 {
+		t.Fatalf("Merged rounds should have IDs but was: %v", importedRounds)
+	}
+	if err := r.MergeHistory(imported, nil, []ct.UserRelation{userRelation("ali", "veli", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	if relations, err = r.GetUserRelations(imported); err != nil {
+		t.Fatal(err)
+	}
+	encounters = make(map[string]int)
+	for _, rel := range relations {
+		encounters[rel.User1+"|"+rel.User2] = rel.Encounters
+	}
+	// ali and veli met once in the rounds, the relation raises it to 3 and
+	// a smaller count leaves it there
+	if expected := map[string]int{"ali|veli": 3, "can|cem": 1}; !reflect.DeepEqual(encounters, expected) {
+		t.Fatalf("Merged relations expected: %v but was: %v", expected, encounters)
+	}
+
+	if users, fetchedAt, err := r.GetUserCache(); err != nil || len(users) != 0 || !fetchedAt.IsZero() {
+		t.Fatalf("User cache should be empty but was: %v fetched at: %v error: %v", users, fetchedAt, err)
+	}
+	if err := r.SaveUserCache([]ct.User{ct.User{ID: "U1", Name: "ali"}, ct.User{ID: "U2", Name: "veli"}}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SaveUserCache([]ct.User{ct.User{ID: "U2", Name: "veli"}, ct.User{ID: "U3", Name: "can", IsBot: true}}, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	users, fetchedAt, err := r.GetUserCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].ID != "U2" || users[1].Name != "can" || !users[1].IsBot || !fetchedAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("User cache should be replaced but was: %v fetched at: %v", users, fetchedAt)
+	}
+
+	schedule := ct.CircleSchedule{Seats: []string{"ali", "veli", ""}, Round: 2}
+	if err := r.SaveSchedule(coffee, schedule); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := r.GetSchedule(coffee); err != nil || !reflect.DeepEqual(saved, schedule) {
+		t.Fatalf("Schedule expected: %v but was: %v error: %v", schedule, saved, err)
+	}
+	if saved, err := r.GetSchedule(tea); err != nil || saved.Round != 0 || len(saved.Seats) != 0 {
+		t.Fatalf("Tea should have no schedule but was: %v error: %v", saved, err)
+	}
+
+	// a round robin round saves its schedule, reverting the latest one
+	// rewinds it while an earlier one stays behind the latest
+	circle := ProgramScope("circle")
+	first := ct.Round{Date: date, Channel: "circle", Strategy: "roundrobin", Groups: [][]string{[]string{"ali", "veli"}}, Schedule: &ct.CircleSchedule{Seats: []string{"ali", "veli"}, Round: 1}}
+	if err := r.SaveRound(circle, &first); err != nil {
+		t.Fatal(err)
+	}
+	second := ct.Round{Date: now, Channel: "circle", Strategy: "roundrobin", Groups: [][]string{[]string{"ali", "veli"}}, Schedule: &ct.CircleSchedule{Seats: []string{"ali", "veli"}, Round: 2}}
+	if err := r.SaveRound(circle, &second); err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := r.GetSchedule(circle); err != nil || !reflect.DeepEqual(saved, *second.Schedule) {
+		t.Fatalf("Schedule expected: %v but was: %v error: %v", *second.Schedule, saved, err)
+	}
+	if reverted, err := r.RevertRound(circle, first.ID); err != nil || reverted.Schedule != nil {
+		t.Fatalf("Reverting an earlier round should not rewind the schedule but was: %v error: %v", reverted.Schedule, err)
+	}
+	if saved, err := r.GetSchedule(circle); err != nil || !reflect.DeepEqual(saved, *second.Schedule) {
+		t.Fatalf("Schedule expected: %v but was: %v error: %v", *second.Schedule, saved, err)
+	}
+	reverted, err = r.RevertRound(circle, second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.Schedule == nil || !reflect.DeepEqual(*reverted.Schedule, *first.Schedule) {
+		t.Fatalf("Schedule should be rewound to: %v but was: %v", *first.Schedule, reverted.Schedule)
+	}
+	if saved, err := r.GetSchedule(circle); err != nil || !reflect.DeepEqual(saved, *first.Schedule) {
+		t.Fatalf("Schedule expected: %v but was: %v error: %v", *first.Schedule, saved, err)
+	}
+
+	if err := r.AddConstraint(coffee, ct.Constraint{Kind: ct.CONSTRAINT_PIN, User1: "ali", Group: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if constraints, err := r.GetConstraints(tea); err != nil || len(constraints) != 0 {
+		t.Fatalf("Tea should have no constraints but was: %v error: %v", constraints, err)
+	}
+	constraints, err := r.GetConstraints(coffee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(constraints) != 1 || constraints[0].User1 != "ali" || constraints[0].Group != 2 {
+		t.Fatalf("Pin constraint expected but was: %v", constraints)
+	}
+	if err := r.RemoveConstraint(coffee, constraints[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if constraints, err = r.GetConstraints(coffee); err != nil || len(constraints) != 0 {
+		t.Fatalf("Constraint should be removed but was: %v error: %v", constraints, err)
+	}
+
+	migrated, err := r.MigrateToUserIDs(coffee, []ct.User{ct.User{ID: "U9", Name: "ali"}})
+	if err != nil || !migrated {
+		t.Fatalf("Migration to user IDs should run, error: %v", err)
+	}
+	if saved, err := r.GetSchedule(coffee); err != nil || saved.Seats[0] != "U9" {
+		t.Fatalf("Seats should be migrated to IDs but was: %v error: %v", saved, err)
+	}
+	relations, err = r.GetUserRelations(coffee)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range relations {
+		if rel.User1 == "ali" || rel.User2 == "ali" || rel.User1 > rel.User2 {
+			t.Fatalf("Relations should be migrated to IDs in canonical order but was: %v", relations)
+		}
+	}
+	if rounds, err = r.GetRounds(coffee); err != nil || rounds[len(rounds)-1].Groups[0][1] != "U9" {
+		t.Fatalf("Rounds should be migrated to IDs but was: %v error: %v", rounds, err)
+	}
+	if migrated, err = r.MigrateToUserIDs(coffee, []ct.User{ct.User{ID: "U9", Name: "ali"}}); err != nil || migrated {
+		t.Fatalf("Migration to user IDs should run once, error: %v", err)
+	}
+	// tea keeps its names until it migrates with its own members
+	hasUser := func(relations []ct.UserRelation, user string) bool {
+		for _, rel := range relations {
+			if rel.User1 == user || rel.User2 == user {
+				return true
+			}
+		}
+		return false
+	}
+	if teaRelations, err = r.GetUserRelations(tea); err != nil || !hasUser(teaRelations, "ali") {
+		t.Fatalf("Tea relations should keep their names but was: %v error: %v", teaRelations, err)
+	}
+	if migrated, err = r.MigrateToUserIDs(tea, []ct.User{ct.User{ID: "U9", Name: "ali"}}); err != nil || !migrated {
+		t.Fatalf("Migration of tea to user IDs should run, error: %v", err)
+	}
+	if teaRelations, err = r.GetUserRelations(tea); err != nil || hasUser(teaRelations, "ali") || !hasUser(teaRelations, "U9") {
+		t.Fatalf("Tea relations should be migrated to IDs but was: %v error: %v", teaRelations, err)
+	}
+}
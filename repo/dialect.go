@@ -0,0 +1,68 @@
+package repo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	DRIVER_SQLITE   = "sqlite3"
+	DRIVER_POSTGRES = "postgres"
+	DRIVER_MEMORY   = "memory"
+	DRIVER_JSON     = "json"
+)
+
+// dialect adapts the SQLite flavoured queries and migrations of the repo to
+// a database driver. The zero dialect is SQLite.
+type dialect struct {
+	numbered bool
+	schema   *strings.Replacer
+}
+
+var postgresDialect = dialect{
+	numbered: true,
+	schema: strings.NewReplacer(
+		"INTEGER PRIMARY KEY AUTOINCREMENT", "BIGSERIAL PRIMARY KEY",
+		"INTEGER", "BIGINT",
+		"MIN(user1, user2)", "LEAST(user1, user2)",
+		"MAX(user1, user2)", "GREATEST(user1, user2)",
+	),
+}
+
+func dialectFor(driver string) (dialect, error) {
+	switch driver {
+	case "", DRIVER_SQLITE:
+		return dialect{}, nil
+	case DRIVER_POSTGRES:
+		return postgresDialect, nil
+	}
+	return dialect{}, fmt.Errorf("Unknown database driver: %s", driver)
+}
+
+// rebind replaces the ? placeholders of query with $1, $2... for drivers
+// with numbered placeholders.
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	b := strings.Builder{}
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// ddl translates a migration written for SQLite.
+func (d dialect) ddl(sql string) string {
+	if d.schema == nil {
+		return sql
+	}
+	return d.schema.Replace(sql)
+}
@@ -0,0 +1,34 @@
+package repo
+
+import "testing"
+
+func TestDialectFor(t *testing.T) {
+	for _, driver := range []string{"", DRIVER_SQLITE, DRIVER_POSTGRES} {
+		if _, err := dialectFor(driver); err != nil {
+			t.Fatalf("Driver %q should be supported: %v", driver, err)
+		}
+	}
+	if _, err := dialectFor("mysql"); err == nil {
+		t.Fatal("Error expected for an unknown driver")
+	}
+}
+func TestRebind(t *testing.T) {
+	query := "INSERT INTO encounter(user1, user2, round_date) values(?,?,?)"
+	if actual := (dialect{}).rebind(query); actual != query {
+		t.Fatalf("SQLite queries should not change but it was: %s", actual)
+	}
+	expected := "INSERT INTO encounter(user1, user2, round_date) values($1,$2,$3)"
+	if actual := postgresDialect.rebind(query); actual != expected {
+		t.Fatalf("Expected: %s but was: %s", expected, actual)
+	}
+}
+func TestDDL(t *testing.T) {
+	ddl := "CREATE TABLE rounds (id INTEGER PRIMARY KEY AUTOINCREMENT, seed INTEGER NOT NULL); SELECT MIN(user1, user2), MAX(user1, user2) FROM user_relation;"
+	expected := "CREATE TABLE rounds (id BIGSERIAL PRIMARY KEY, seed BIGINT NOT NULL); SELECT LEAST(user1, user2), GREATEST(user1, user2) FROM user_relation;"
+	if actual := postgresDialect.ddl(ddl); actual != expected {
+		t.Fatalf("Expected: %s but was: %s", expected, actual)
+	}
+	if actual := (dialect{}).ddl(ddl); actual != ddl {
+		t.Fatalf("SQLite migrations should not change but it was: %s", actual)
+	}
+}
@@ -0,0 +1,123 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// JSON_LOCK_WAIT is how long a change waits for another process to
+	// release the lock file of a JSON file.
+	JSON_LOCK_WAIT = 5 * time.Second
+	// JSON_LOCK_STALE is the age a lock file is taken over at, left behind
+	// by a process that crashed while changing the file.
+	JSON_LOCK_STALE = time.Minute
+)
+
+// NewJSONFile returns a repo keeping everything in the JSON file at path,
+// readable and friendly to version control. The file is created on the first
+// change and rewritten as a whole on every change. Processes sharing the file
+// take turns through the lock file next to it, and a change is made on the
+// file as it is after taking the lock. The user cache is kept in a file of
+// its own, see userCachePath, out of the history.
+func NewJSONFile(path string) (Repo, error) {
+	s, err := readJSONFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cachePath := userCachePath(path)
+	cache := userCache{}
+	if err = readJSON(cachePath, &cache); err != nil {
+		return nil, err
+	}
+	return &memoryRepo{
+		state:        s,
+		users:        cache,
+		lock:         func() (func(), error) { return lockJSONFile(path) },
+		load:         func() (*store, error) { return readJSONFile(path) },
+		persist:      func(s *store) error { return writeJSONFile(path, s) },
+		persistUsers: func(cache userCache) error { return writeJSONFile(cachePath, cache) },
+	}, nil
+}
+
+// userCachePath returns the path of the user cache file of the JSON file at
+// path, coffeetable.users.json for coffeetable.json.
+func userCachePath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + ".users" + ext
+}
+
+// readJSONFile reads the state in the file at path, empty when there is no
+// file yet.
+func readJSONFile(path string) (*store, error) {
+	s := newStore()
+	if err := readJSON(path, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readJSON reads the file at path into v, leaving v as it is when there is
+// no file.
+func readJSON(path string, v interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+// lockJSONFile creates the lock file of the file at path, waiting for
+// another process holding it, and returns the func removing it.
+func lockJSONFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	deadline := time.Now().Add(JSON_LOCK_WAIT)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > JSON_LOCK_STALE {
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s is locked by another process, remove %s if none is running!", path, lockPath)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeJSONFile replaces the file at path with v through a temporary file,
+// so a crash never leaves a half-written file behind.
+func writeJSONFile(path string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
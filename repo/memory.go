@@ -0,0 +1,498 @@
+package repo
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	ct "github.com/mtyurt/coffeetable"
+)
+
+// store is the whole state of a repo kept outside a database.
+type store struct {
+	Programs   map[string]*programStore `json:"programs"`
+	Locks      map[string]runLock       `json:"locks"`
+	Migrations []string                 `json:"migrations"`
+	NextIDs    map[string]int           `json:"nextIds"`
+}
+
+// userCache is the cached users of the workspace, kept apart from the
+// history in store.
+type userCache struct {
+	Users     []ct.User `json:"users"`
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+type runLock struct {
+	Owner      string    `json:"owner"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+}
+
+// programStore is the state of a program. Relations and encounters of a
+// program sharing the history of another one are kept in the other one.
+// ScheduleBefore keeps the schedule each round robin round replaced, by
+// round ID.
+type programStore struct {
+	Relations      []ct.UserRelation         `json:"relations"`
+	Schedule       ct.CircleSchedule         `json:"schedule"`
+	Constraints    []ct.Constraint           `json:"constraints"`
+	Encounters     []ct.Encounter            `json:"encounters"`
+	Rounds         []ct.Round                `json:"rounds"`
+	ScheduleBefore map[int]ct.CircleSchedule `json:"scheduleBefore,omitempty"`
+}
+
+func newStore() *store {
+	return &store{
+		Programs:   make(map[string]*programStore),
+		Locks:      make(map[string]runLock),
+		Migrations: []string{},
+		NextIDs:    make(map[string]int),
+	}
+}
+
+// program returns the state of program, empty for an unknown program.
+func (s *store) program(program string) *programStore {
+	if p, ok := s.Programs[program]; ok {
+		return p
+	}
+	return &programStore{}
+}
+
+// updateProgram returns the state of program to change, adding it if needed.
+func (s *store) updateProgram(program string) *programStore {
+	if _, ok := s.Programs[program]; !ok {
+		s.Programs[program] = &programStore{}
+	}
+	return s.Programs[program]
+}
+
+// nextID returns the next ID of kind, starting from 1 like the database.
+func (s *store) nextID(kind string) int {
+	s.NextIDs[kind]++
+	return s.NextIDs[kind]
+}
+func (s *store) clone() (*store, error) {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	c := newStore()
+	return c, json.Unmarshal(content, c)
+}
+
+// memoryRepo keeps the repo state in memory. Every change is made on a copy
+// of the state and handed to persist, so a failing change leaves the state
+// as it was. A repo shared with other processes takes lock for a change and
+// makes it on the state it loads meanwhile. The user cache is handed to
+// persistUsers instead.
+type memoryRepo struct {
+	mu           sync.Mutex
+	state        *store
+	users        userCache
+	lock         func() (func(), error)
+	load         func() (*store, error)
+	persist      func(*store) error
+	persistUsers func(userCache) error
+}
+
+// NewMemory returns a repo keeping everything in memory.
+func NewMemory() Repo {
+	return &memoryRepo{state: newStore()}
+}
+func (r *memoryRepo) read(f func(s *store)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f(r.state)
+}
+func (r *memoryRepo) update(f func(s *store) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lock != nil {
+		unlock, err := r.lock()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		loaded, err := r.load()
+		if err != nil {
+			return err
+		}
+		r.state = loaded
+	}
+	s, err := r.state.clone()
+	if err != nil {
+		return err
+	}
+	if err = f(s); err != nil {
+		return err
+	}
+	if r.persist != nil {
+		if err = r.persist(s); err != nil {
+			return err
+		}
+	}
+	r.state = s
+	return nil
+}
+func (r *memoryRepo) GetUserRelations(scope Scope) (relations []ct.UserRelation, err error) {
+	r.read(func(s *store) {
+		relations = append([]ct.UserRelation{}, s.program(scope.history()).Relations...)
+	})
+	return
+}
+func (r *memoryRepo) UpdateEncounters(scope Scope, rel ct.UserRelation) error {
+	return r.update(func(s *store) error {
+		user1, user2 := canonicalPair(rel.User1, rel.User2)
+		s.upsertRelation(scope.history(), user1, user2, func(int) int { return rel.Encounters })
+		return nil
+	})
+}
+func (s *store) upsertRelation(program string, user1 string, user2 string, encounters func(int) int) {
+	p := s.updateProgram(program)
+	for i, rel := range p.Relations {
+		if rel.User1 == user1 && rel.User2 == user2 {
+			p.Relations[i].Encounters = encounters(rel.Encounters)
+			return
+		}
+	}
+	p.Relations = append(p.Relations, ct.UserRelation{ID: s.nextID("user_relation"), User1: user1, User2: user2, Encounters: encounters(0)})
+}
+func (r *memoryRepo) GetSchedule(scope Scope) (schedule ct.CircleSchedule, err error) {
+	r.read(func(s *store) {
+		schedule = copySchedule(s.program(scope.Program).Schedule)
+	})
+	return
+}
+func copySchedule(schedule ct.CircleSchedule) ct.CircleSchedule {
+	c := ct.CircleSchedule{Round: schedule.Round}
+	if schedule.Seats != nil {
+		c.Seats = append([]string{}, schedule.Seats...)
+	}
+	return c
+}
+func (r *memoryRepo) SaveSchedule(scope Scope, schedule ct.CircleSchedule) error {
+	return r.update(func(s *store) error {
+		s.updateProgram(scope.Program).Schedule = schedule
+		return nil
+	})
+}
+func (r *memoryRepo) GetConstraints(scope Scope) (constraints []ct.Constraint, err error) {
+	r.read(func(s *store) {
+		constraints = append([]ct.Constraint{}, s.program(scope.Program).Constraints...)
+	})
+	return
+}
+func (r *memoryRepo) AddConstraint(scope Scope, c ct.Constraint) error {
+	return r.update(func(s *store) error {
+		p := s.updateProgram(scope.Program)
+		c.ID = s.nextID("user_constraint")
+		p.Constraints = append(p.Constraints, c)
+		return nil
+	})
+}
+func (r *memoryRepo) RemoveConstraint(scope Scope, id int) error {
+	return r.update(func(s *store) error {
+		p := s.updateProgram(scope.Program)
+		for i, c := range p.Constraints {
+			if c.ID == id {
+				p.Constraints = append(p.Constraints[:i], p.Constraints[i+1:]...)
+				break
+			}
+		}
+		return nil
+	})
+}
+func (r *memoryRepo) GetEncounters(scope Scope) (encounters []ct.Encounter, err error) {
+	r.read(func(s *store) {
+		encounters = append([]ct.Encounter{}, s.program(scope.history()).Encounters...)
+	})
+	return
+}
+
+// GetRecentEncounters returns the encounters of the last rounds rounds.
+func (r *memoryRepo) GetRecentEncounters(scope Scope, rounds int) (encounters []ct.Encounter, err error) {
+	r.read(func(s *store) {
+		all := s.program(scope.history()).Encounters
+		dates := []time.Time{}
+		seen := make(map[int64]bool)
+		for _, e := range all {
+			if !seen[e.Date.UnixNano()] {
+				seen[e.Date.UnixNano()] = true
+				dates = append(dates, e.Date)
+			}
+		}
+		sort.Slice(dates, func(i, j int) bool { return dates[i].After(dates[j]) })
+		recent := make(map[int64]bool)
+		for i := 0; i < rounds && i < len(dates); i++ {
+			recent[dates[i].UnixNano()] = true
+		}
+		encounters = []ct.Encounter{}
+		for _, e := range all {
+			if recent[e.Date.UnixNano()] {
+				encounters = append(encounters, e)
+			}
+		}
+	})
+	return
+}
+
+// MigrateToUserIDs rewrites the history, rounds, constraints and schedule of
+// scope stored by user name to the IDs of users, once per program, like the
+// database repo does.
+func (r *memoryRepo) MigrateToUserIDs(scope Scope, users []ct.User) (migrated bool, err error) {
+	err = r.update(func(s *store) error {
+		for _, m := range s.Migrations {
+			if m == userIDMigration(scope.Program) {
+				return nil
+			}
+		}
+		ids := userIDsByName(users)
+		id := func(name string) string {
+			if id := ids[name]; id != "" {
+				return id
+			}
+			return name
+		}
+		history := s.updateProgram(scope.history())
+		for i, rel := range history.Relations {
+			history.Relations[i].User1, history.Relations[i].User2 = canonicalPair(id(rel.User1), id(rel.User2))
+		}
+		for i, e := range history.Encounters {
+			history.Encounters[i].User1, history.Encounters[i].User2 = id(e.User1), id(e.User2)
+		}
+		p := s.updateProgram(scope.Program)
+		for i, c := range p.Constraints {
+			p.Constraints[i].User1, p.Constraints[i].User2 = id(c.User1), id(c.User2)
+		}
+		for i, seat := range p.Schedule.Seats {
+			p.Schedule.Seats[i] = id(seat)
+		}
+		for _, round := range p.Rounds {
+			for _, g := range round.Groups {
+				for i, user := range g {
+					g[i] = id(user)
+				}
+			}
+		}
+		s.Migrations = append(s.Migrations, userIDMigration(scope.Program))
+		migrated = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return migrated, nil
+}
+
+// SaveRound saves the round with its groups in the program of scope, its
+// encounters and the relations of its pairs in the history of scope, at
+// once, and sets its ID. The schedule of a round robin round replaces the
+// schedule of the program like in the database repo, as do UTC dates.
+func (r *memoryRepo) SaveRound(scope Scope, round *ct.Round) error {
+	id := 0
+	err := r.update(func(s *store) (err error) {
+		id, err = s.saveRound(scope, *round)
+		return
+	})
+	if err == nil {
+		round.ID = id
+	}
+	return err
+}
+func (s *store) saveRound(scope Scope, round ct.Round) (int, error) {
+	for _, saved := range s.program(scope.Program).Rounds {
+		if round.Key != "" && saved.Key == round.Key && !saved.Reverted {
+			return 0, fmt.Errorf("Round %s of program %s is already saved!", round.Key, scope.Program)
+		}
+	}
+	id := s.nextID("rounds")
+	saved := round
+	saved.ID = id
+	saved.Date = round.Date.UTC()
+	saved.Schedule = nil
+	saved.Groups = make([][]string, len(round.Groups))
+	for i, g := range round.Groups {
+		saved.Groups[i] = append([]string{}, g...)
+	}
+	p := s.updateProgram(scope.Program)
+	p.Rounds = append(p.Rounds, saved)
+	if round.Schedule != nil {
+		if p.ScheduleBefore == nil {
+			p.ScheduleBefore = make(map[int]ct.CircleSchedule)
+		}
+		p.ScheduleBefore[id] = copySchedule(p.Schedule)
+		p.Schedule = copySchedule(*round.Schedule)
+	}
+	history := s.updateProgram(scope.history())
+	for _, e := range saved.Encounters() {
+		history.Encounters = append(history.Encounters, e)
+		user1, user2 := canonicalPair(e.User1, e.User2)
+		s.upsertRelation(scope.history(), user1, user2, func(encounters int) int { return encounters + 1 })
+	}
+	return id, nil
+}
+
+// MergeHistory saves imported rounds like SaveRound, setting their IDs, then
+// raises the encounters of each relation to at least its count, at once.
+func (r *memoryRepo) MergeHistory(scope Scope, rounds []ct.Round, relations []ct.UserRelation) error {
+	ids := make([]int, len(rounds))
+	err := r.update(func(s *store) (err error) {
+		for i, round := range rounds {
+			if ids[i], err = s.saveRound(scope, round); err != nil {
+				return
+			}
+		}
+		for _, rel := range relations {
+			user1, user2 := canonicalPair(rel.User1, rel.User2)
+			s.upsertRelation(scope.history(), user1, user2, func(encounters int) int {
+				if rel.Encounters > encounters {
+					return rel.Encounters
+				}
+				return encounters
+			})
+		}
+		return nil
+	})
+	if err == nil {
+		for i := range rounds {
+			rounds[i].ID = ids[i]
+		}
+	}
+	return err
+}
+
+// GetRounds returns the saved rounds of the program, latest first.
+func (r *memoryRepo) GetRounds(scope Scope) (rounds []ct.Round, err error) {
+	r.read(func(s *store) {
+		saved := s.program(scope.Program).Rounds
+		rounds = make([]ct.Round, len(saved))
+		for i, round := range saved {
+			rounds[i] = round
+			rounds[i].Groups = make([][]string, len(round.Groups))
+			for j, g := range round.Groups {
+				rounds[i].Groups[j] = append([]string{}, g...)
+			}
+		}
+		sort.SliceStable(rounds, func(i, j int) bool {
+			if !rounds[i].Date.Equal(rounds[j].Date) {
+				return rounds[i].Date.After(rounds[j].Date)
+			}
+			return rounds[i].ID > rounds[j].ID
+		})
+	})
+	return
+}
+
+// SetRoundMessage records the Slack timestamp of the announcement of a round.
+func (r *memoryRepo) SetRoundMessage(scope Scope, id int, ts string) error {
+	return r.update(func(s *store) error {
+		p := s.updateProgram(scope.Program)
+		for i := range p.Rounds {
+			if p.Rounds[i].ID == id {
+				p.Rounds[i].MessageTS = ts
+			}
+		}
+		return nil
+	})
+}
+
+// RevertRound takes back the encounters a round added to the history of
+// scope and marks it reverted. A round robin round rewinds the schedule of
+// the program unless a later round robin round is saved. It returns the
+// round without its groups, with the rewound schedule if any.
+func (r *memoryRepo) RevertRound(scope Scope, id int) (round ct.Round, err error) {
+	err = r.update(func(s *store) error {
+		p := s.updateProgram(scope.Program)
+		i := 0
+		for i < len(p.Rounds) && p.Rounds[i].ID != id {
+			i++
+		}
+		if i == len(p.Rounds) {
+			return fmt.Errorf("Round %d is not found!", id)
+		}
+		if p.Rounds[i].Reverted {
+			return fmt.Errorf("Round %d is already rolled back!", id)
+		}
+		history := s.updateProgram(scope.history())
+		for _, e := range p.Rounds[i].Encounters() {
+			for j, saved := range history.Encounters {
+				if saved.User1 == e.User1 && saved.User2 == e.User2 && saved.Date.Equal(e.Date) {
+					history.Encounters = append(history.Encounters[:j], history.Encounters[j+1:]...)
+					break
+				}
+			}
+			user1, user2 := canonicalPair(e.User1, e.User2)
+			for j, rel := range history.Relations {
+				if rel.User1 == user1 && rel.User2 == user2 && rel.Encounters > 0 {
+					history.Relations[j].Encounters--
+				}
+			}
+		}
+		p.Rounds[i].Reverted = true
+		round = p.Rounds[i]
+		round.Groups = nil
+		before, ok := p.ScheduleBefore[id]
+		if !ok {
+			return nil
+		}
+		for _, later := range p.Rounds {
+			if _, roundRobin := p.ScheduleBefore[later.ID]; roundRobin && later.ID > id && !later.Reverted {
+				return nil
+			}
+		}
+		p.Schedule = copySchedule(before)
+		rewound := copySchedule(before)
+		round.Schedule = &rewound
+		return nil
+	})
+	return
+}
+
+// AcquireRunLock takes the run lock of the program for owner, unless another
+// owner took it less than ttl ago. It reports whether the lock is taken.
+func (r *memoryRepo) AcquireRunLock(scope Scope, owner string, now time.Time, ttl time.Duration) (acquired bool, err error) {
+	err = r.update(func(s *store) error {
+		lock, ok := s.Locks[scope.Program]
+		if ok && lock.Owner != owner && !lock.AcquiredAt.Before(now.Add(-ttl)) {
+			return nil
+		}
+		s.Locks[scope.Program] = runLock{owner, now.UTC()}
+		acquired = true
+		return nil
+	})
+	return
+}
+
+// ReleaseRunLock releases the run lock of the program if owner holds it.
+func (r *memoryRepo) ReleaseRunLock(scope Scope, owner string) error {
+	return r.update(func(s *store) error {
+		if s.Locks[scope.Program].Owner == owner {
+			delete(s.Locks, scope.Program)
+		}
+		return nil
+	})
+}
+
+// GetUserCache returns the cached users of the workspace and when they were
+// fetched, the zero time when nothing is cached.
+func (r *memoryRepo) GetUserCache() ([]ct.User, time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ct.User{}, r.users.Users...), r.users.FetchedAt, nil
+}
+
+// SaveUserCache replaces the cached users of the workspace.
+func (r *memoryRepo) SaveUserCache(users []ct.User, fetchedAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cache := userCache{Users: append([]ct.User{}, users...), FetchedAt: fetchedAt.UTC()}
+	if r.persistUsers != nil {
+		if err := r.persistUsers(cache); err != nil {
+			return err
+		}
+	}
+	r.users = cache
+	return nil
+}
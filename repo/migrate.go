@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migration is a schema change, its version is the number its file name
+// starts with.
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations := []migration{}
+	for _, e := range entries {
+		prefix := strings.SplitN(e.Name(), "_", 2)[0]
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("Migration %s does not start with a version: %v", e.Name(), err)
+		}
+		content, err := migrationFiles.ReadFile("migrations/" + e.Name())
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version, e.Name(), string(content)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrate applies the migrations newer than the schema version of db in
+// order, in one transaction, and returns the names of the applied ones.
+func Migrate(db *sql.DB, driver string) ([]string, error) {
+	d, err := dialectFor(driver)
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	return migrate(db, d, migrations)
+}
+func migrate(db *sql.DB, d dialect, migrations []migration) (applied []string, err error) {
+	if _, err = db.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, name VARCHAR(128) NOT NULL, applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)"); err != nil {
+		return
+	}
+	current := 0
+	if err = db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current); err != nil {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+			applied = nil
+		}
+	}()
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if _, err = tx.Exec(d.ddl(m.SQL)); err != nil {
+			err = fmt.Errorf("Migration %s failed: %w", m.Name, err)
+			return
+		}
+		if _, err = tx.Exec(d.rebind("INSERT INTO schema_version(version, name) values(?,?)"), m.Version, m.Name); err != nil {
+			return
+		}
+		applied = append(applied, m.Name)
+	}
+	return
+}
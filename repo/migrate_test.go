@@ -0,0 +1,87 @@
+package repo
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestLoadMigrationsShouldBeOrderedByVersion(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("Embedded migrations expected")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Fatalf("Migration %s should have version %d but it was: %d", m.Name, i+1, m.Version)
+		}
+		if m.SQL == "" {
+			t.Fatalf("Migration %s is empty", m.Name)
+		}
+	}
+}
+func TestMigrateShouldApplyNewerMigrationsInOneTransaction(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	migrations := []migration{
+		migration{1, "001_a.sql", "CREATE TABLE a (id INTEGER);"},
+		migration{2, "002_b.sql", "CREATE TABLE b (id INTEGER);"},
+		migration{3, "003_c.sql", "CREATE TABLE c (id INTEGER);"},
+	}
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_version .*").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COALESCE[(]MAX[(]version[)], 0[)] FROM schema_version").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE b .*").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_version[(]version, name[)] values[(][?],[?][)]").WithArgs(2, "002_b.sql").WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectExec("CREATE TABLE c .*").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_version[(]version, name[)] values[(][?],[?][)]").WithArgs(3, "003_c.sql").WillReturnResult(sqlmock.NewResult(3, 1))
+	mock.ExpectCommit()
+	applied, err := migrate(db, dialect{}, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"002_b.sql", "003_c.sql"}; !reflect.DeepEqual(applied, expected) {
+		t.Fatalf("Applied migrations expected: %v but was: %v", expected, applied)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
+func TestMigrateShouldRollbackWhenAMigrationFails(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	migrations := []migration{
+		migration{1, "001_a.sql", "CREATE TABLE a (id INTEGER);"},
+		migration{2, "002_b.sql", "CREATE TABLE b (id INTEGER);"},
+	}
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_version .*").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COALESCE[(]MAX[(]version[)], 0[)] FROM schema_version").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(0))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE a .*").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_version[(]version, name[)] values[(][?],[?][)]").WithArgs(1, "001_a.sql").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("CREATE TABLE b .*").WillReturnError(errors.New("syntax error"))
+	mock.ExpectRollback()
+	applied, err := migrate(db, dialect{}, migrations)
+	if err == nil {
+		t.Fatal("Migration should fail")
+	}
+	if applied != nil {
+		t.Fatalf("No migration should be reported as applied but it was: %v", applied)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expections: %s", err)
+	}
+}
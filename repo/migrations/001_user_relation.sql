@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS user_relation (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user1 VARCHAR(64) NOT NULL,
+    user2 VARCHAR(64) NOT NULL,
+    encounters INTEGER
+);
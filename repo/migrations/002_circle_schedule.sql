@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS circle_schedule (
+    id INTEGER PRIMARY KEY,
+    round INTEGER NOT NULL,
+    seats TEXT NOT NULL
+);
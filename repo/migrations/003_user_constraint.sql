@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS user_constraint (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind VARCHAR(16) NOT NULL,
+    user1 VARCHAR(64) NOT NULL,
+    user2 VARCHAR(64) NOT NULL,
+    group_index INTEGER NOT NULL DEFAULT 0
+);
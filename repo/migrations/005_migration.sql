@@ -0,0 +1,3 @@
+CREATE TABLE IF NOT EXISTS migration (
+    name VARCHAR(64) PRIMARY KEY
+);
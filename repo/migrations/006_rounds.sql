@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS rounds (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    round_date TIMESTAMP NOT NULL,
+    channel VARCHAR(64) NOT NULL,
+    strategy VARCHAR(16) NOT NULL,
+    seed INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS round_members (
+    round_id INTEGER NOT NULL REFERENCES rounds(id),
+    group_index INTEGER NOT NULL,
+    user_id VARCHAR(64) NOT NULL
+);
@@ -0,0 +1,12 @@
+CREATE TABLE user_relation_canonical (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user1 VARCHAR(64) NOT NULL,
+    user2 VARCHAR(64) NOT NULL,
+    encounters INTEGER
+);
+INSERT INTO user_relation_canonical(user1, user2, encounters)
+SELECT MIN(user1, user2), MAX(user1, user2), SUM(encounters) FROM user_relation
+GROUP BY MIN(user1, user2), MAX(user1, user2);
+DROP TABLE user_relation;
+ALTER TABLE user_relation_canonical RENAME TO user_relation;
+CREATE UNIQUE INDEX user_relation_pair ON user_relation(user1, user2);
@@ -0,0 +1 @@
+ALTER TABLE round_members ADD COLUMN position INTEGER NOT NULL DEFAULT 0;
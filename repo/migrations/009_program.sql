@@ -0,0 +1,15 @@
+ALTER TABLE user_relation ADD COLUMN program VARCHAR(64) NOT NULL DEFAULT '';
+DROP INDEX user_relation_pair;
+CREATE UNIQUE INDEX user_relation_program_pair ON user_relation(program, user1, user2);
+ALTER TABLE encounter ADD COLUMN program VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE user_constraint ADD COLUMN program VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE rounds ADD COLUMN program VARCHAR(64) NOT NULL DEFAULT '';
+CREATE TABLE circle_schedule_program (
+    program VARCHAR(64) PRIMARY KEY,
+    round INTEGER NOT NULL,
+    seats TEXT NOT NULL
+);
+INSERT INTO circle_schedule_program(program, round, seats)
+SELECT '', round, seats FROM circle_schedule WHERE id=1;
+DROP TABLE circle_schedule;
+ALTER TABLE circle_schedule_program RENAME TO circle_schedule;
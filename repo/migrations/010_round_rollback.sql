@@ -0,0 +1,7 @@
+ALTER TABLE rounds ADD COLUMN message_ts VARCHAR(32) NOT NULL DEFAULT '';
+ALTER TABLE rounds ADD COLUMN reverted BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE encounter ADD COLUMN round_id INTEGER REFERENCES rounds(id);
+UPDATE encounter SET round_id = (
+    SELECT MAX(rounds.id) FROM rounds JOIN round_members ON round_members.round_id = rounds.id
+    WHERE rounds.round_date = encounter.round_date AND round_members.user_id = encounter.user1
+);
@@ -0,0 +1,7 @@
+ALTER TABLE rounds ADD COLUMN run_key VARCHAR(32) NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX rounds_run_key ON rounds(program, run_key) WHERE run_key <> '' AND reverted = FALSE;
+CREATE TABLE IF NOT EXISTS run_lock (
+    program VARCHAR(64) PRIMARY KEY,
+    owner VARCHAR(128) NOT NULL,
+    acquired_at TIMESTAMP NOT NULL
+);
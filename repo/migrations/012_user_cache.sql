@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS user_cache (
+    id VARCHAR(64) PRIMARY KEY,
+    profile TEXT NOT NULL,
+    fetched_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE rounds ADD COLUMN schedule TEXT NOT NULL DEFAULT '';
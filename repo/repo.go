@@ -2,27 +2,90 @@ package repo
 
 import (
 	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	ct "github.com/mtyurt/coffeetable"
 )
 
+// USER_ID_MIGRATION marks the migration from user names to user IDs, per
+// program, see userIDMigration.
+const USER_ID_MIGRATION = "user_ids"
+
+// UPSERT_RELATION inserts a relation or, for an existing pair, updates it
+// with the SET clause appended to it.
+const UPSERT_RELATION = "INSERT INTO user_relation(program, user1, user2, encounters) values(?,?,?,?) ON CONFLICT(program, user1, user2) DO UPDATE SET "
+
+// Scope is the program the data of a repo call belongs to. Rounds, the
+// schedule and constraints are kept per program, relations and encounters
+// per History, which is the program itself unless it shares the history of
+// another program.
+type Scope struct {
+	Program string
+	History string
+}
+
+// ProgramScope returns the scope of a program keeping its own history.
+func ProgramScope(program string) Scope {
+	return Scope{Program: program, History: program}
+}
+func (s Scope) history() string {
+	if s.History == "" {
+		return s.Program
+	}
+	return s.History
+}
+
 type repo struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect dialect
+}
+
+// execer runs the queries of the repo on a database or in a transaction.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
 }
 type Repo interface {
-	GetUserRelations() ([]ct.UserRelation, error)
-	UpdateEncounters(ct.UserRelation) error
+	GetUserRelations(Scope) ([]ct.UserRelation, error)
+	UpdateEncounters(Scope, ct.UserRelation) error
+	GetSchedule(Scope) (ct.CircleSchedule, error)
+	SaveSchedule(Scope, ct.CircleSchedule) error
+	GetConstraints(Scope) ([]ct.Constraint, error)
+	AddConstraint(Scope, ct.Constraint) error
+	RemoveConstraint(scope Scope, id int) error
+	GetEncounters(Scope) ([]ct.Encounter, error)
+	GetRecentEncounters(scope Scope, rounds int) ([]ct.Encounter, error)
+	MigrateToUserIDs(Scope, []ct.User) (bool, error)
+	SaveRound(Scope, *ct.Round) error
+	MergeHistory(scope Scope, rounds []ct.Round, relations []ct.UserRelation) error
+	GetRounds(Scope) ([]ct.Round, error)
+	SetRoundMessage(scope Scope, id int, ts string) error
+	RevertRound(scope Scope, id int) (ct.Round, error)
+	AcquireRunLock(scope Scope, owner string, now time.Time, ttl time.Duration) (bool, error)
+	ReleaseRunLock(scope Scope, owner string) error
+	GetUserCache() ([]ct.User, time.Time, error)
+	SaveUserCache(users []ct.User, fetchedAt time.Time) error
 }
 
+// New returns a repo on an SQLite database. It does not create any tables,
+// Migrate has to run on the database first.
 func New(db *sql.DB) Repo {
-	return &repo{db}
+	return &repo{db: db}
 }
-func (r *repo) GetUserRelations() ([]ct.UserRelation, error) {
-	if err := r.checkTable(); err != nil {
+
+// NewWithDriver returns a repo on a database opened with the given driver,
+// migrated with Migrate like for New.
+func NewWithDriver(driver string, db *sql.DB) (Repo, error) {
+	d, err := dialectFor(driver)
+	if err != nil {
 		return nil, err
 	}
-	rows, err := r.db.Query("SELECT * FROM user_relation")
+	return &repo{db, d}, nil
+}
+func (r *repo) GetUserRelations(scope Scope) ([]ct.UserRelation, error) {
+	rows, err := r.db.Query(r.dialect.rebind("SELECT id, user1, user2, encounters FROM user_relation WHERE program=?"), scope.history())
 	if err != nil {
 		return nil, err
 	}
@@ -41,42 +104,213 @@ func (r *repo) GetUserRelations() ([]ct.UserRelation, error) {
 	return relations, nil
 }
 
-func (r *repo) checkTable() error {
-	rows, err := r.db.Query("SELECT name FROM sqlite_master WHERE type='table';")
+// UpdateEncounters sets the encounters of the pair in rel, in either order.
+func (r *repo) UpdateEncounters(scope Scope, rel ct.UserRelation) error {
+	user1, user2 := canonicalPair(rel.User1, rel.User2)
+	_, err := r.db.Exec(r.dialect.rebind(UPSERT_RELATION+"encounters=excluded.encounters"), scope.history(), user1, user2, rel.Encounters)
+	return err
+}
+
+// canonicalPair orders a user pair the way user_relation stores it.
+func canonicalPair(user1 string, user2 string) (string, string) {
+	if user2 < user1 {
+		return user2, user1
+	}
+	return user1, user2
+}
+func (r *repo) GetSchedule(scope Scope) (ct.CircleSchedule, error) {
+	return r.getSchedule(r.db, scope)
+}
+func (r *repo) getSchedule(db execer, scope Scope) (schedule ct.CircleSchedule, err error) {
+	rows, err := db.Query(r.dialect.rebind("SELECT round, seats FROM circle_schedule WHERE program=?"), scope.Program)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return
+	}
+	seats := ""
+	if err = rows.Scan(&schedule.Round, &seats); err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(seats), &schedule.Seats)
+	return
+}
+func (r *repo) SaveSchedule(scope Scope, schedule ct.CircleSchedule) error {
+	return r.saveSchedule(r.db, scope, schedule)
+}
+func (r *repo) saveSchedule(db execer, scope Scope, schedule ct.CircleSchedule) error {
+	seats, err := json.Marshal(schedule.Seats)
 	if err != nil {
 		return err
 	}
+	_, err = db.Exec(r.dialect.rebind("INSERT INTO circle_schedule(program, round, seats) values(?,?,?) ON CONFLICT(program) DO UPDATE SET round=excluded.round, seats=excluded.seats"), scope.Program, schedule.Round, string(seats))
+	return err
+}
+func (r *repo) GetConstraints(scope Scope) ([]ct.Constraint, error) {
+	rows, err := r.db.Query(r.dialect.rebind("SELECT id, kind, user1, user2, group_index FROM user_constraint WHERE program=?"), scope.Program)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
+	constraints := []ct.Constraint{}
 	for rows.Next() {
-		tableName := ""
-		err = rows.Scan(&tableName)
-		if err != nil {
-			return err
+		c := ct.Constraint{}
+		if err = rows.Scan(&c.ID, &c.Kind, &c.User1, &c.User2, &c.Group); err != nil {
+			return nil, err
 		}
-		if tableName == "user_relation" {
-			return nil
+		constraints = append(constraints, c)
+	}
+	return constraints, rows.Err()
+}
+func (r *repo) AddConstraint(scope Scope, c ct.Constraint) error {
+	_, err := r.db.Exec(r.dialect.rebind("INSERT INTO user_constraint(program, kind, user1, user2, group_index) values(?,?,?,?,?)"), scope.Program, c.Kind, c.User1, c.User2, c.Group)
+	return err
+}
+func (r *repo) RemoveConstraint(scope Scope, id int) error {
+	_, err := r.db.Exec(r.dialect.rebind("DELETE FROM user_constraint WHERE program=? AND id=?"), scope.Program, id)
+	return err
+}
+func (r *repo) GetEncounters(scope Scope) ([]ct.Encounter, error) {
+	return r.queryEncounters("SELECT user1, user2, round_date FROM encounter WHERE program=?", scope.history())
+}
+
+// GetRecentEncounters returns the encounters of the last rounds rounds.
+func (r *repo) GetRecentEncounters(scope Scope, rounds int) ([]ct.Encounter, error) {
+	return r.queryEncounters("SELECT user1, user2, round_date FROM encounter WHERE program=? AND round_date IN (SELECT DISTINCT round_date FROM encounter WHERE program=? ORDER BY round_date DESC LIMIT ?)", scope.history(), scope.history(), rounds)
+}
+func (r *repo) queryEncounters(query string, args ...interface{}) ([]ct.Encounter, error) {
+	rows, err := r.db.Query(r.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	encounters := []ct.Encounter{}
+	for rows.Next() {
+		e := ct.Encounter{}
+		if err = rows.Scan(&e.User1, &e.User2, &e.Date); err != nil {
+			return nil, err
 		}
+		encounters = append(encounters, e)
 	}
+	return encounters, rows.Err()
+}
 
-	_, err = r.db.Exec(`
-CREATE TABLE user_relation (
-    id INTEGER PRIMARY KEY AUTOINCREMENT,
-    user1 VARCHAR(64) NOT NULL,
-    user2 VARCHAR(64) NOT NULL,
-    encounters INTEGER
-)
-	`)
+// MigrateToUserIDs rewrites the history, rounds, constraints and schedule of
+// scope stored by user name to the IDs of users, the members of its channel,
+// once per program. Names shared by several users are ambiguous and names of
+// users not in users are unknown, rows with those names are left as they
+// are. It reports whether the migration ran.
+func (r *repo) MigrateToUserIDs(scope Scope, users []ct.User) (migrated bool, err error) {
+	rows, err := r.db.Query(r.dialect.rebind("SELECT name FROM migration WHERE name=?"), userIDMigration(scope.Program))
+	if err != nil {
+		return
+	}
+	done := rows.Next()
+	rows.Close()
+	if done {
+		return
+	}
+	ids := userIDsByName(users)
 
-	return err
+	tx, err := r.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+	for _, u := range users {
+		name, id := u.Name, ids[u.Name]
+		if id == "" || id == name {
+			continue
+		}
+		for _, query := range []struct {
+			sql     string
+			program string
+		}{
+			{"UPDATE user_relation SET user1=? WHERE user1=? AND program=?", scope.history()},
+			{"UPDATE user_relation SET user2=? WHERE user2=? AND program=?", scope.history()},
+			{"UPDATE encounter SET user1=? WHERE user1=? AND program=?", scope.history()},
+			{"UPDATE encounter SET user2=? WHERE user2=? AND program=?", scope.history()},
+			{"UPDATE user_constraint SET user1=? WHERE user1=? AND program=?", scope.Program},
+			{"UPDATE user_constraint SET user2=? WHERE user2=? AND program=?", scope.Program},
+			{"UPDATE round_members SET user_id=? WHERE user_id=? AND round_id IN (SELECT id FROM rounds WHERE program=?)", scope.Program},
+		} {
+			if _, err = tx.Exec(r.dialect.rebind(query.sql), id, name, query.program); err != nil {
+				return
+			}
+		}
+	}
+	if _, err = tx.Exec(r.dialect.rebind("UPDATE user_relation SET user1=user2, user2=user1 WHERE program=? AND user1 > user2"), scope.history()); err != nil {
+		return
+	}
+	if err = migrateSeats(tx, r.dialect, scope.Program, ids); err != nil {
+		return
+	}
+	if _, err = tx.Exec(r.dialect.rebind("INSERT INTO migration(name) values(?)"), userIDMigration(scope.Program)); err != nil {
+		return
+	}
+	return true, nil
 }
-func (r *repo) UpdateEncounters(rel ct.UserRelation) (err error) {
-	if err := r.checkTable(); err != nil {
+
+// userIDMigration names the migration of program to user IDs.
+func userIDMigration(program string) string {
+	return USER_ID_MIGRATION + ":" + program
+}
+
+// userIDsByName maps user names to IDs, names shared by several users map
+// to an empty ID.
+func userIDsByName(users []ct.User) map[string]string {
+	ids := make(map[string]string)
+	for _, u := range users {
+		if _, ok := ids[u.Name]; ok {
+			ids[u.Name] = ""
+		} else {
+			ids[u.Name] = u.ID
+		}
+	}
+	return ids
+}
+func migrateSeats(tx *sql.Tx, d dialect, program string, ids map[string]string) error {
+	seats := ""
+	err := tx.QueryRow(d.rebind("SELECT seats FROM circle_schedule WHERE program=?"), program).Scan(&seats)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
 		return err
 	}
-	user1 := rel.User1
-	user2 := rel.User2
-	encounters := rel.Encounters
+	names := []string{}
+	if err = json.Unmarshal([]byte(seats), &names); err != nil {
+		return err
+	}
+	for i, name := range names {
+		if id := ids[name]; id != "" {
+			names[i] = id
+		}
+	}
+	migratedSeats, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(d.rebind("UPDATE circle_schedule SET seats=? WHERE program=?"), string(migratedSeats), program)
+	return err
+}
 
+// SaveRound saves the round with its groups in the program of scope, its
+// encounters and the relations of its pairs in the history of scope, in one
+// transaction, and sets its ID. The schedule of a round robin round replaces
+// the schedule of the program, the replaced one is kept with the round to
+// rewind it when the round is reverted. Dates are stored in UTC, Postgres
+// drops the offset of a timestamp without time zone.
+func (r *repo) SaveRound(scope Scope, round *ct.Round) (err error) {
 	tx, err := r.db.Begin()
 	if err != nil {
 		return
@@ -89,24 +323,276 @@ func (r *repo) UpdateEncounters(rel ct.UserRelation) (err error) {
 			tx.Rollback()
 		}
 	}()
+	return r.saveRound(tx, scope, round)
+}
+func (r *repo) saveRound(tx *sql.Tx, scope Scope, round *ct.Round) (err error) {
+	before := ""
+	if round.Schedule != nil {
+		schedule, err := r.getSchedule(tx, scope)
+		if err != nil {
+			return err
+		}
+		content, err := json.Marshal(schedule)
+		if err != nil {
+			return err
+		}
+		before = string(content)
+	}
 	id := 0
-	rows, err := tx.Query("SELECT id FROM user_relation WHERE ( user1=? AND user2=? ) OR ( user2=? AND user1=? )", user1, user2, user1, user2)
+	if err = tx.QueryRow(r.dialect.rebind("INSERT INTO rounds(program, round_date, channel, strategy, seed, run_key, schedule) values(?,?,?,?,?,?,?) RETURNING id"), scope.Program, round.Date.UTC(), round.Channel, round.Strategy, round.Seed, round.Key, before).Scan(&id); err != nil {
+		return
+	}
+	for i, g := range round.Groups {
+		for j, userID := range g {
+			if _, err = tx.Exec(r.dialect.rebind("INSERT INTO round_members(round_id, group_index, position, user_id) values(?,?,?,?)"), id, i, j, userID); err != nil {
+				return
+			}
+		}
+	}
+	for _, e := range round.Encounters() {
+		if _, err = tx.Exec(r.dialect.rebind("INSERT INTO encounter(program, user1, user2, round_date, round_id) values(?,?,?,?,?)"), scope.history(), e.User1, e.User2, e.Date.UTC(), id); err != nil {
+			return
+		}
+		user1, user2 := canonicalPair(e.User1, e.User2)
+		if _, err = tx.Exec(r.dialect.rebind(UPSERT_RELATION+"encounters=user_relation.encounters+1"), scope.history(), user1, user2, 1); err != nil {
+			return
+		}
+	}
+	if round.Schedule != nil {
+		if err = r.saveSchedule(tx, scope, *round.Schedule); err != nil {
+			return
+		}
+	}
+	round.ID = id
+	return
+}
+
+// MergeHistory saves imported rounds like SaveRound, setting their IDs, then
+// raises the encounters of each relation to at least its count, in one
+// transaction.
+func (r *repo) MergeHistory(scope Scope, rounds []ct.Round, relations []ct.UserRelation) (err error) {
+	tx, err := r.db.Begin()
 	if err != nil {
-		return err
+		return
 	}
-	if rows.Next() {
-		if err = rows.Scan(&id); err != nil {
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+	for i := range rounds {
+		if err = r.saveRound(tx, scope, &rounds[i]); err != nil {
 			return
 		}
-	} else {
-		if _, err = tx.Exec("INSERT INTO user_relation(user1, user2, encounters) values(?,?,?)", user1, user2, encounters); err != nil {
+	}
+	for _, rel := range relations {
+		user1, user2 := canonicalPair(rel.User1, rel.User2)
+		if _, err = tx.Exec(r.dialect.rebind(UPSERT_RELATION+"encounters=CASE WHEN excluded.encounters > user_relation.encounters THEN excluded.encounters ELSE user_relation.encounters END"), scope.history(), user1, user2, rel.Encounters); err != nil {
 			return
 		}
+	}
+	return
+}
+
+// GetRounds returns the saved rounds of the program, latest first.
+func (r *repo) GetRounds(scope Scope) ([]ct.Round, error) {
+	rows, err := r.db.Query(r.dialect.rebind("SELECT id, round_date, channel, strategy, seed, run_key, message_ts, reverted FROM rounds WHERE program=? ORDER BY round_date DESC, id DESC"), scope.Program)
+	if err != nil {
+		return nil, err
+	}
+	rounds := []ct.Round{}
+	index := make(map[int]int)
+	for rows.Next() {
+		round := ct.Round{}
+		if err = rows.Scan(&round.ID, &round.Date, &round.Channel, &round.Strategy, &round.Seed, &round.Key, &round.MessageTS, &round.Reverted); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[round.ID] = len(rounds)
+		rounds = append(rounds, round)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = r.db.Query(r.dialect.rebind("SELECT round_id, group_index, user_id FROM round_members WHERE round_id IN (SELECT id FROM rounds WHERE program=?) ORDER BY round_id, group_index, position"), scope.Program)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		roundID, group, userID := 0, 0, ""
+		if err = rows.Scan(&roundID, &group, &userID); err != nil {
+			return nil, err
+		}
+		i, ok := index[roundID]
+		if !ok {
+			continue
+		}
+		for len(rounds[i].Groups) <= group {
+			rounds[i].Groups = append(rounds[i].Groups, []string{})
+		}
+		rounds[i].Groups[group] = append(rounds[i].Groups[group], userID)
+	}
+	return rounds, rows.Err()
+}
+
+// SetRoundMessage records the Slack timestamp of the announcement of a round.
+func (r *repo) SetRoundMessage(scope Scope, id int, ts string) error {
+	_, err := r.db.Exec(r.dialect.rebind("UPDATE rounds SET message_ts=? WHERE program=? AND id=?"), ts, scope.Program, id)
+	return err
+}
+
+// RevertRound takes back the encounters a round added to the relations and
+// marks it reverted, in one transaction. A round robin round rewinds the
+// schedule of the program unless a later round robin round is saved. It
+// returns the round without its groups, with the rewound schedule if any.
+func (r *repo) RevertRound(scope Scope, id int) (round ct.Round, err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+	before := ""
+	err = tx.QueryRow(r.dialect.rebind("SELECT id, round_date, channel, strategy, seed, run_key, message_ts, reverted, schedule FROM rounds WHERE program=? AND id=?"), scope.Program, id).
+		Scan(&round.ID, &round.Date, &round.Channel, &round.Strategy, &round.Seed, &round.Key, &round.MessageTS, &round.Reverted, &before)
+	if err == sql.ErrNoRows {
+		err = fmt.Errorf("Round %d is not found!", id)
+	}
+	if err != nil {
 		return
 	}
+	if round.Reverted {
+		err = fmt.Errorf("Round %d is already rolled back!", id)
+		return
+	}
+	rows, err := tx.Query(r.dialect.rebind("SELECT program, user1, user2 FROM encounter WHERE round_id=?"), id)
+	if err != nil {
+		return
+	}
+	type encounter struct{ program, user1, user2 string }
+	encounters := []encounter{}
+	for rows.Next() {
+		e := encounter{}
+		if err = rows.Scan(&e.program, &e.user1, &e.user2); err != nil {
+			rows.Close()
+			return
+		}
+		encounters = append(encounters, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+	for _, e := range encounters {
+		user1, user2 := canonicalPair(e.user1, e.user2)
+		if _, err = tx.Exec(r.dialect.rebind("UPDATE user_relation SET encounters=encounters-1 WHERE program=? AND user1=? AND user2=? AND encounters > 0"), e.program, user1, user2); err != nil {
+			return
+		}
+	}
+	if _, err = tx.Exec(r.dialect.rebind("DELETE FROM encounter WHERE round_id=?"), id); err != nil {
+		return
+	}
+	if _, err = tx.Exec(r.dialect.rebind("UPDATE rounds SET reverted=? WHERE id=?"), true, id); err != nil {
+		return
+	}
+	round.Reverted = true
+	if before == "" {
+		return
+	}
+	later := 0
+	if err = tx.QueryRow(r.dialect.rebind("SELECT COUNT(*) FROM rounds WHERE program=? AND id>? AND schedule<>'' AND reverted=?"), scope.Program, id, false).Scan(&later); err != nil || later > 0 {
+		return
+	}
+	schedule := ct.CircleSchedule{}
+	if err = json.Unmarshal([]byte(before), &schedule); err != nil {
+		return
+	}
+	if err = r.saveSchedule(tx, scope, schedule); err != nil {
+		return
+	}
+	round.Schedule = &schedule
+	return
+}
 
-	if _, err = tx.Exec("UPDATE user_relation SET encounters=? WHERE id=?", encounters, id); err != nil {
+// AcquireRunLock takes the run lock of the program for owner, unless another
+// owner took it less than ttl ago. It reports whether the lock is taken.
+func (r *repo) AcquireRunLock(scope Scope, owner string, now time.Time, ttl time.Duration) (bool, error) {
+	res, err := r.db.Exec(r.dialect.rebind("INSERT INTO run_lock(program, owner, acquired_at) values(?,?,?) ON CONFLICT(program) DO UPDATE SET owner=excluded.owner, acquired_at=excluded.acquired_at WHERE run_lock.owner=excluded.owner OR run_lock.acquired_at < ?"),
+		scope.Program, owner, now.UTC(), now.Add(-ttl).UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// ReleaseRunLock releases the run lock of the program if owner holds it.
+func (r *repo) ReleaseRunLock(scope Scope, owner string) error {
+	_, err := r.db.Exec(r.dialect.rebind("DELETE FROM run_lock WHERE program=? AND owner=?"), scope.Program, owner)
+	return err
+}
+
+// GetUserCache returns the cached users of the workspace and when they were
+// fetched, the zero time when nothing is cached.
+func (r *repo) GetUserCache() ([]ct.User, time.Time, error) {
+	fetchedAt := time.Time{}
+	rows, err := r.db.Query("SELECT profile, fetched_at FROM user_cache ORDER BY id")
+	if err != nil {
+		return nil, fetchedAt, err
+	}
+	defer rows.Close()
+	users := []ct.User{}
+	for rows.Next() {
+		profile := ""
+		if err = rows.Scan(&profile, &fetchedAt); err != nil {
+			return nil, time.Time{}, err
+		}
+		u := ct.User{}
+		if err = json.Unmarshal([]byte(profile), &u); err != nil {
+			return nil, time.Time{}, err
+		}
+		users = append(users, u)
+	}
+	return users, fetchedAt, rows.Err()
+}
+
+// SaveUserCache replaces the cached users of the workspace.
+func (r *repo) SaveUserCache(users []ct.User, fetchedAt time.Time) (err error) {
+	tx, err := r.db.Begin()
+	if err != nil {
 		return
 	}
+	defer func() {
+		switch err {
+		case nil:
+			err = tx.Commit()
+		default:
+			tx.Rollback()
+		}
+	}()
+	if _, err = tx.Exec("DELETE FROM user_cache"); err != nil {
+		return
+	}
+	for _, u := range users {
+		profile, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(r.dialect.rebind("INSERT INTO user_cache(id, profile, fetched_at) values(?,?,?)"), u.ID, string(profile), fetchedAt.UTC()); err != nil {
+			return err
+		}
+	}
 	return
 }
@@ -4,12 +4,46 @@ import (
 	"database/sql"
 	"errors"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	ct "github.com/mtyurt/coffeetable"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 )
 
+var coffee = ProgramScope("coffee")
+
+// forEachDialect runs test on a stub database in every dialect. query turns
+// the pattern of an expected query, with [?] placeholders, into the pattern
+// of the dialect.
+func forEachDialect(t *testing.T, test func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string)) {
+	for _, driver := range []string{DRIVER_SQLITE, DRIVER_POSTGRES} {
+		t.Run(driver, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			d, err := dialectFor(driver)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test(t, repo{db: db, dialect: d}, mock, func(pattern string) string {
+				if driver != DRIVER_POSTGRES {
+					return pattern
+				}
+				parts := strings.Split(pattern, "[?]")
+				for i := 1; i < len(parts); i++ {
+					parts[i] = "[$]" + strconv.Itoa(i) + parts[i]
+				}
+				return strings.Join(parts, "")
+			})
+		})
+	}
+}
+
 func TestNew(t *testing.T) {
 	db := &sql.DB{}
 	r := New(db)
@@ -25,28 +59,23 @@ func TestNew(t *testing.T) {
 	}
 }
 func TestShouldGetUsers(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
-	}
-	defer db.Close()
-	r := repo{db}
-	rows := sqlmock.NewRows([]string{"id", "user1", "user2", "encounters"}).
-		AddRow(1, "ali", "veli", 3).
-		AddRow(2, "veli", "ahmet", 1)
-	mock.ExpectQuery("SELECT name FROM sqlite_master WHERE type='table';").WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("user_relation"))
-	mock.ExpectQuery("SELECT [*] FROM user_relation").WillReturnRows(rows)
-	relations, err := r.GetUserRelations()
-	if err != nil {
-		t.Fatal(err)
-	}
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+		rows := sqlmock.NewRows([]string{"id", "user1", "user2", "encounters"}).
+			AddRow(1, "ali", "veli", 3).
+			AddRow(2, "veli", "ahmet", 1)
+		mock.ExpectQuery(query("SELECT id, user1, user2, encounters FROM user_relation WHERE program=[?]")).WithArgs("coffee").WillReturnRows(rows)
+		relations, err := r.GetUserRelations(coffee)
+		if err != nil {
+			t.Fatal(err)
+		}
 
-	checkUser(t, ct.UserRelation{1, "ali", "veli", 3}, relations[0])
-	checkUser(t, ct.UserRelation{2, "veli", "ahmet", 1}, relations[1])
+		checkUser(t, ct.UserRelation{1, "ali", "veli", 3}, relations[0])
+		checkUser(t, ct.UserRelation{2, "veli", "ahmet", 1}, relations[1])
 
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expections: %s", err)
-	}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
 }
 
 func checkUser(t *testing.T, expected ct.UserRelation, actual ct.UserRelation) {
@@ -55,76 +84,401 @@ func checkUser(t *testing.T, expected ct.UserRelation, actual ct.UserRelation) {
 		t.Fatalf("User does not match! expected: %v actual: %v", expected, actual)
 	}
 }
-func TestCheckTableShouldCreateTableWhenAbsent(t *testing.T) {
+func TestUpdateEncountersShouldUpsertCanonicalPair(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
 
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
-	}
-	defer db.Close()
-	r := repo{db}
+		upsert := query("INSERT INTO user_relation[(]program, user1, user2, encounters[)] values[(][?],[?],[?],[?][)] ON CONFLICT[(]program, user1, user2[)] DO UPDATE SET encounters=excluded.encounters")
+		mock.ExpectExec(upsert).WithArgs("coffee", "ali", "veli", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(upsert).WithArgs("coffee", "ali", "veli", 3).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(upsert).WithArgs("coffee", "ali", "veli", 4).WillReturnError(errors.New("query failed"))
 
-	mock.ExpectQuery("SELECT name FROM sqlite_master WHERE type='table';").WillReturnRows(sqlmock.NewRows([]string{"table"}))
-	mock.ExpectExec(`CREATE TABLE user_relation .*`).WillReturnResult(sqlmock.NewResult(1, 1))
-	if err = r.checkTable(); err != nil {
-		t.Fatal(err)
-	}
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expections: %s", err)
-	}
+		if err := r.UpdateEncounters(coffee, userRelation("ali", "veli", 1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.UpdateEncounters(coffee, userRelation("veli", "ali", 3)); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.UpdateEncounters(coffee, userRelation("veli", "ali", 4)); err == nil {
+			t.Fatal("Query should fail")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
 }
-func TestIncreaseEncounterShouldSucceed(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
-	}
-	defer db.Close()
-	r := repo{db}
-
-	mock.ExpectQuery("SELECT name FROM sqlite_master WHERE type='table';").WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("user_relation"))
-	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT id FROM user_relation WHERE [(] user1=[?] AND user2=[?] [)] OR [(] user2=[?] AND user1=[?] [)]").WithArgs("ali", "veli", "ali", "veli").WillReturnRows(sqlmock.NewRows([]string{"id"}))
-	mock.ExpectExec("INSERT INTO user_relation(.*)").WithArgs("ali", "veli", 1).WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectCommit()
-	//second run
-	mock.ExpectQuery("SELECT name FROM sqlite_master WHERE type='table';").WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("user_relation"))
-	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT id FROM user_relation WHERE [(] user1=[?] AND user2=[?] [)] OR [(] user2=[?] AND user1=[?] [)]").WithArgs("veli", "ali", "veli", "ali").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
-	mock.ExpectExec("UPDATE user_relation SET encounters=[?] WHERE id=[?]").WithArgs(3, 1).WillReturnResult(sqlmock.NewResult(1, 1))
-	mock.ExpectCommit()
-
-	if err := r.UpdateEncounters(userRelation("ali", "veli", 1)); err != nil {
-		t.Fatal(err)
-	}
+func userRelation(user1 string, user2 string, encounters int) ct.UserRelation {
+	return ct.UserRelation{User1: user1, User2: user2, Encounters: encounters}
+}
+func TestGetScheduleShouldReturnSavedSchedule(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
 
-	if err = r.UpdateEncounters(userRelation("veli", "ali", 3)); err != nil {
-		t.Fatal(err)
-	}
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expections: %s", err)
-	}
+		mock.ExpectQuery(query("SELECT round, seats FROM circle_schedule WHERE program=[?]")).WithArgs("coffee").WillReturnRows(sqlmock.NewRows([]string{"round", "seats"}).AddRow(3, `["ali","","veli","deli"]`))
+		schedule, err := r.GetSchedule(coffee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := ct.CircleSchedule{Seats: []string{"ali", "", "veli", "deli"}, Round: 3}
+		if !reflect.DeepEqual(schedule, expected) {
+			t.Fatalf("Schedule expected: %v but was: %v", expected, schedule)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
 }
-func TestUpdateEncountersShouldRollbackWhenSqlFails(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
-	}
-	defer db.Close()
-	r := repo{db}
+func TestGetScheduleShouldReturnEmptyScheduleWhenNoneIsSaved(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
 
-	mock.ExpectQuery("SELECT name FROM sqlite_master WHERE type='table';").WillReturnRows(sqlmock.NewRows([]string{"table"}).AddRow("user_relation"))
-	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT id FROM user_relation WHERE [(] user1=[?] AND user2=[?] [)] OR [(] user2=[?] AND user1=[?] [)]").WithArgs("ali", "veli", "ali", "veli").WillReturnError(errors.New("query failed"))
-	mock.ExpectRollback()
+		mock.ExpectQuery(query("SELECT round, seats FROM circle_schedule WHERE program=[?]")).WithArgs("coffee").WillReturnRows(sqlmock.NewRows([]string{"round", "seats"}))
+		schedule, err := r.GetSchedule(coffee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if schedule.Round != 0 || len(schedule.Seats) != 0 {
+			t.Fatalf("Empty schedule expected but was: %v", schedule)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestSaveSchedule(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
 
-	if err := r.UpdateEncounters(userRelation("ali", "veli", 1)); err == nil {
-		t.Fatal("Query should fail")
-	}
+		mock.ExpectExec(query("INSERT INTO circle_schedule[(]program, round, seats[)] values[(][?],[?],[?][)] ON CONFLICT[(]program[)] DO UPDATE .*")).WithArgs("coffee", 4, `["ali","","veli","deli"]`).WillReturnResult(sqlmock.NewResult(1, 1))
+		if err := r.SaveSchedule(coffee, ct.CircleSchedule{Seats: []string{"ali", "", "veli", "deli"}, Round: 4}); err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestGetConstraints(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
 
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expections: %s", err)
-	}
+		mock.ExpectQuery(query("SELECT id, kind, user1, user2, group_index FROM user_constraint WHERE program=[?]")).WithArgs("coffee").WillReturnRows(sqlmock.NewRows([]string{"id", "kind", "user1", "user2", "group_index"}).
+			AddRow(1, "apart", "ali", "veli", 0).
+			AddRow(3, "apart", "deli", "ali", 0).
+			AddRow(4, "pin", "can", "", 2))
+		constraints, err := r.GetConstraints(coffee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []ct.Constraint{
+			ct.Constraint{ID: 1, Kind: "apart", User1: "ali", User2: "veli"},
+			ct.Constraint{ID: 3, Kind: "apart", User1: "deli", User2: "ali"},
+			ct.Constraint{ID: 4, Kind: "pin", User1: "can", Group: 2},
+		}
+		if !reflect.DeepEqual(constraints, expected) {
+			t.Fatalf("Constraints expected: %v but was: %v", expected, constraints)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
 }
-func userRelation(user1 string, user2 string, encounters int) ct.UserRelation {
-	return ct.UserRelation{User1: user1, User2: user2, Encounters: encounters}
+func TestAddAndRemoveConstraint(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		mock.ExpectExec(query("INSERT INTO user_constraint[(]program, kind, user1, user2, group_index[)] values[(][?],[?],[?],[?],[?][)]")).WithArgs("coffee", "apart", "ali", "veli", 0).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(query("DELETE FROM user_constraint WHERE program=[?] AND id=[?]")).WithArgs("coffee", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		if err := r.AddConstraint(coffee, ct.Constraint{Kind: "apart", User1: "ali", User2: "veli"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.RemoveConstraint(coffee, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestGetEncounters(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+		mock.ExpectQuery(query("SELECT user1, user2, round_date FROM encounter WHERE program=[?]")).WithArgs("coffee").WillReturnRows(sqlmock.NewRows([]string{"user1", "user2", "round_date"}).
+			AddRow("ali", "veli", date).
+			AddRow("deli", "ali", date))
+		encounters, err := r.GetEncounters(coffee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []ct.Encounter{
+			ct.Encounter{User1: "ali", User2: "veli", Date: date},
+			ct.Encounter{User1: "deli", User2: "ali", Date: date},
+		}
+		if !reflect.DeepEqual(encounters, expected) {
+			t.Fatalf("Encounters expected: %v but was: %v", expected, encounters)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestGetRecentEncounters(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+		mock.ExpectQuery(query("SELECT user1, user2, round_date FROM encounter WHERE program=[?] AND round_date IN [(]SELECT DISTINCT round_date FROM encounter WHERE program=[?] ORDER BY round_date DESC LIMIT [?][)]")).
+			WithArgs("coffee", "coffee", 2).
+			WillReturnRows(sqlmock.NewRows([]string{"user1", "user2", "round_date"}).AddRow("ali", "veli", date))
+		encounters, err := r.GetRecentEncounters(coffee, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []ct.Encounter{ct.Encounter{User1: "ali", User2: "veli", Date: date}}
+		if !reflect.DeepEqual(encounters, expected) {
+			t.Fatalf("Encounters expected: %v but was: %v", expected, encounters)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+
+func TestMigrateToUserIDs(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		// lunch shares the history of coffee
+		mock.ExpectQuery(query("SELECT name FROM migration WHERE name=[?]")).WithArgs("user_ids:lunch").WillReturnRows(sqlmock.NewRows([]string{"name"}))
+		mock.ExpectBegin()
+		for _, table := range []struct{ name, program string }{{"user_relation", "coffee"}, {"encounter", "coffee"}, {"user_constraint", "lunch"}} {
+			for _, column := range []string{"user1", "user2"} {
+				mock.ExpectExec(query("UPDATE "+table.name+" SET "+column+"=[?] WHERE "+column+"=[?] AND program=[?]")).WithArgs("U1", "ali", table.program).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+		}
+		mock.ExpectExec(query("UPDATE round_members SET user_id=[?] WHERE user_id=[?] AND round_id IN [(]SELECT id FROM rounds WHERE program=[?][)]")).WithArgs("U1", "ali", "lunch").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(query("UPDATE user_relation SET user1=user2, user2=user1 WHERE program=[?] AND user1 > user2")).WithArgs("coffee").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(query("SELECT seats FROM circle_schedule WHERE program=[?]")).WithArgs("lunch").WillReturnRows(sqlmock.NewRows([]string{"seats"}).AddRow(`["ali","veli",""]`))
+		mock.ExpectExec(query("UPDATE circle_schedule SET seats=[?] WHERE program=[?]")).WithArgs(`["U1","veli",""]`, "lunch").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(query("INSERT INTO migration[(]name[)] values[(][?][)]")).WithArgs("user_ids:lunch").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		migrated, err := r.MigrateToUserIDs(Scope{Program: "lunch", History: "coffee"}, []ct.User{
+			ct.User{ID: "U1", Name: "ali"},
+			ct.User{ID: "U2", Name: "veli"},
+			ct.User{ID: "U3", Name: "veli"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !migrated {
+			t.Fatal("Migration should run")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestMigrateToUserIDsShouldRunOnce(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		mock.ExpectQuery(query("SELECT name FROM migration WHERE name=[?]")).WithArgs("user_ids:coffee").WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("user_ids:coffee"))
+		migrated, err := r.MigrateToUserIDs(coffee, []ct.User{ct.User{ID: "U1", Name: "ali"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if migrated {
+			t.Fatal("Migration should not run twice")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestSaveRound(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+		mock.ExpectBegin()
+		mock.ExpectQuery(query("INSERT INTO rounds[(]program, round_date, channel, strategy, seed, run_key, schedule[)] values[(][?],[?],[?],[?],[?],[?],[?][)] RETURNING id")).WithArgs("lunch", date, "coffee", "random", 7, "2019-10-18", "").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+		mock.ExpectExec(query("INSERT INTO round_members[(]round_id, group_index, position, user_id[)] values[(][?],[?],[?],[?][)]")).WithArgs(3, 0, 0, "U2").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(query("INSERT INTO round_members[(]round_id, group_index, position, user_id[)] values[(][?],[?],[?],[?][)]")).WithArgs(3, 0, 1, "U1").WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectExec(query("INSERT INTO round_members[(]round_id, group_index, position, user_id[)] values[(][?],[?],[?],[?][)]")).WithArgs(3, 1, 0, "U3").WillReturnResult(sqlmock.NewResult(3, 1))
+		mock.ExpectExec(query("INSERT INTO encounter[(]program, user1, user2, round_date, round_id[)] values[(][?],[?],[?],[?],[?][)]")).WithArgs("coffee", "U2", "U1", date, 3).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(query("INSERT INTO user_relation[(]program, user1, user2, encounters[)] values[(][?],[?],[?],[?][)] ON CONFLICT[(]program, user1, user2[)] DO UPDATE SET encounters=user_relation.encounters[+]1")).WithArgs("coffee", "U1", "U2", 1).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		round := ct.Round{Date: date, Channel: "coffee", Strategy: "random", Seed: 7, Groups: [][]string{[]string{"U2", "U1"}, []string{"U3"}}, Key: "2019-10-18"}
+		// lunch shares the history of coffee
+		if err := r.SaveRound(Scope{Program: "lunch", History: "coffee"}, &round); err != nil {
+			t.Fatal(err)
+		}
+		if round.ID != 3 {
+			t.Fatalf("Round ID should be set to 3 but it was: %d", round.ID)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestSaveRoundShouldRollbackWhenSqlFails(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+		mock.ExpectBegin()
+		mock.ExpectQuery(query("INSERT INTO rounds.*")).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+		mock.ExpectExec(query("INSERT INTO round_members.*")).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(query("INSERT INTO round_members.*")).WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectExec(query("INSERT INTO encounter.*")).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(query("INSERT INTO user_relation.*")).WillReturnError(errors.New("disk full"))
+		mock.ExpectRollback()
+		round := ct.Round{Date: date, Channel: "coffee", Strategy: "random", Seed: 7, Groups: [][]string{[]string{"U1", "U2"}}}
+		if err := r.SaveRound(coffee, &round); err == nil {
+			t.Fatal("Save should fail")
+		}
+		if round.ID != 0 {
+			t.Fatalf("Round ID should not be set but it was: %d", round.ID)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestGetRounds(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+		mock.ExpectQuery(query("SELECT id, round_date, channel, strategy, seed, run_key, message_ts, reverted FROM rounds WHERE program=[?] ORDER BY round_date DESC, id DESC")).WithArgs("coffee").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "round_date", "channel", "strategy", "seed", "run_key", "message_ts", "reverted"}).
+				AddRow(2, date, "coffee", "optimize", 8, "2019-10-18", "1571400000.000200", false).
+				AddRow(1, date.Add(-7*24*time.Hour), "coffee", "random", 7, "", "", true))
+		mock.ExpectQuery(query("SELECT round_id, group_index, user_id FROM round_members WHERE round_id IN [(]SELECT id FROM rounds WHERE program=[?][)] ORDER BY round_id, group_index, position")).WithArgs("coffee").
+			WillReturnRows(sqlmock.NewRows([]string{"round_id", "group_index", "user_id"}).
+				AddRow(1, 0, "U1").
+				AddRow(1, 0, "U2").
+				AddRow(2, 0, "U1").
+				AddRow(2, 1, "U2"))
+		rounds, err := r.GetRounds(coffee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []ct.Round{
+			ct.Round{ID: 2, Date: date, Channel: "coffee", Strategy: "optimize", Seed: 8, Groups: [][]string{[]string{"U1"}, []string{"U2"}}, Key: "2019-10-18", MessageTS: "1571400000.000200"},
+			ct.Round{ID: 1, Date: date.Add(-7 * 24 * time.Hour), Channel: "coffee", Strategy: "random", Seed: 7, Groups: [][]string{[]string{"U1", "U2"}}, Reverted: true},
+		}
+		if !reflect.DeepEqual(rounds, expected) {
+			t.Fatalf("Rounds expected: %v but was: %v", expected, rounds)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestRevertRound(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+		columns := []string{"id", "round_date", "channel", "strategy", "seed", "run_key", "message_ts", "reverted", "schedule"}
+		mock.ExpectBegin()
+		mock.ExpectQuery(query("SELECT id, round_date, channel, strategy, seed, run_key, message_ts, reverted, schedule FROM rounds WHERE program=[?] AND id=[?]")).WithArgs("coffee", 3).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(3, date, "coffee", "random", 7, "2019-10-18", "1571400000.000200", false, ""))
+		mock.ExpectQuery(query("SELECT program, user1, user2 FROM encounter WHERE round_id=[?]")).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"program", "user1", "user2"}).AddRow("coffee", "U2", "U1"))
+		mock.ExpectExec(query("UPDATE user_relation SET encounters=encounters-1 WHERE program=[?] AND user1=[?] AND user2=[?] AND encounters > 0")).WithArgs("coffee", "U1", "U2").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(query("DELETE FROM encounter WHERE round_id=[?]")).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(query("UPDATE rounds SET reverted=[?] WHERE id=[?]")).WithArgs(true, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		round, err := r.RevertRound(coffee, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !round.Reverted || round.MessageTS != "1571400000.000200" {
+			t.Fatalf("Reverted round with its message expected but was: %v", round)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(query("SELECT id, round_date, channel, strategy, seed, run_key, message_ts, reverted, schedule FROM rounds .*")).WithArgs("coffee", 3).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(3, date, "coffee", "random", 7, "2019-10-18", "", true, ""))
+		mock.ExpectRollback()
+		if _, err := r.RevertRound(coffee, 3); err == nil {
+			t.Fatal("A reverted round should not be reverted again")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestRevertRoundShouldRewindTheScheduleOfTheLatestRoundRobinRound(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+		columns := []string{"id", "round_date", "channel", "strategy", "seed", "run_key", "message_ts", "reverted", "schedule"}
+		mock.ExpectBegin()
+		mock.ExpectQuery(query("SELECT id, round_date, channel, strategy, seed, run_key, message_ts, reverted, schedule FROM rounds .*")).WithArgs("coffee", 3).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(3, date, "coffee", "roundrobin", 7, "2019-10-18", "", false, `{"Seats":["ali","veli"],"Round":0}`))
+		mock.ExpectQuery(query("SELECT program, user1, user2 FROM encounter .*")).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"program", "user1", "user2"}))
+		mock.ExpectExec(query("DELETE FROM encounter .*")).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(query("UPDATE rounds SET reverted=[?] .*")).WithArgs(true, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(query("SELECT COUNT[(][*][)] FROM rounds WHERE program=[?] AND id>[?] AND schedule<>'' AND reverted=[?]")).WithArgs("coffee", 3, false).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+		mock.ExpectExec(query("INSERT INTO circle_schedule.*")).WithArgs("coffee", 0, `["ali","veli"]`).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		round, err := r.RevertRound(coffee, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := ct.CircleSchedule{Seats: []string{"ali", "veli"}}
+		if round.Schedule == nil || !reflect.DeepEqual(*round.Schedule, expected) {
+			t.Fatalf("Schedule should be rewound to %v but was: %v", expected, round.Schedule)
+		}
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(query("SELECT id, round_date, channel, strategy, seed, run_key, message_ts, reverted, schedule FROM rounds .*")).WithArgs("coffee", 2).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(2, date, "coffee", "roundrobin", 7, "", "", false, `{"Seats":[],"Round":0}`))
+		mock.ExpectQuery(query("SELECT program, user1, user2 FROM encounter .*")).WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"program", "user1", "user2"}))
+		mock.ExpectExec(query("DELETE FROM encounter .*")).WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(query("UPDATE rounds SET reverted=[?] .*")).WithArgs(true, 2).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(query("SELECT COUNT[(][*][)] FROM rounds .*")).WithArgs("coffee", 2, false).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+		mock.ExpectCommit()
+		round, err = r.RevertRound(coffee, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if round.Schedule != nil {
+			t.Fatalf("Schedule should not be rewound behind a later round robin round but was: %v", round.Schedule)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestAcquireRunLock(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		now := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+		acquire := query("INSERT INTO run_lock[(]program, owner, acquired_at[)] values[(][?],[?],[?][)] ON CONFLICT[(]program[)] DO UPDATE SET .* WHERE run_lock.owner=excluded.owner OR run_lock.acquired_at < [?]")
+		mock.ExpectExec(acquire).WithArgs("coffee", "host:1", now, now.Add(-time.Hour)).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(acquire).WithArgs("coffee", "host:2", now, now.Add(-time.Hour)).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(query("DELETE FROM run_lock WHERE program=[?] AND owner=[?]")).WithArgs("coffee", "host:1").WillReturnResult(sqlmock.NewResult(0, 1))
+		if acquired, err := r.AcquireRunLock(coffee, "host:1", now, time.Hour); err != nil || !acquired {
+			t.Fatalf("Lock should be acquired, error: %v", err)
+		}
+		if acquired, err := r.AcquireRunLock(coffee, "host:2", now, time.Hour); err != nil || acquired {
+			t.Fatalf("Lock held by another owner should not be acquired, error: %v", err)
+		}
+		if err := r.ReleaseRunLock(coffee, "host:1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
+}
+func TestSaveUserCacheShouldReplaceUsersInOneTransaction(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, r repo, mock sqlmock.Sqlmock, query func(string) string) {
+
+		now := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+		mock.ExpectBegin()
+		mock.ExpectExec(query("DELETE FROM user_cache")).WillReturnResult(sqlmock.NewResult(0, 3))
+		mock.ExpectExec(query("INSERT INTO user_cache[(]id, profile, fetched_at[)] values[(][?],[?],[?][)]")).WithArgs("U1", sqlmock.AnyArg(), now).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(query("INSERT INTO user_cache.*")).WithArgs("U2", sqlmock.AnyArg(), now).WillReturnError(errors.New("disk full"))
+		mock.ExpectRollback()
+		if err := r.SaveUserCache([]ct.User{ct.User{ID: "U1", Name: "ali"}, ct.User{ID: "U2", Name: "veli"}}, now); err == nil {
+			t.Fatal("Save should fail")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expections: %s", err)
+		}
+	})
 }
@@ -0,0 +1,51 @@
+package coffeetable
+
+import "time"
+
+// Round is a published round: when and where it ran, how its groups were
+// generated and the Slack user IDs of each group. Key identifies the run
+// that made it, a program has a single round per key. MessageTS is the
+// Slack timestamp of its announcement, a reverted round is rolled back and
+// no longer counts. Schedule is the round robin schedule after a round robin
+// round, saved along with the round.
+type Round struct {
+	ID        int
+	Date      time.Time
+	Channel   string
+	Strategy  string
+	Seed      int64
+	Groups    [][]string
+	Key       string
+	MessageTS string
+	Reverted  bool
+	Schedule  *CircleSchedule
+}
+
+// RunKey is the key of the round a program runs at date, one per day.
+func RunKey(date time.Time) string {
+	return date.Format("2006-01-02")
+}
+
+func NewRound(date time.Time, channel string, strategy string, seed int64, groups [][]User) Round {
+	ids := make([][]string, len(groups))
+	for i, g := range groups {
+		ids[i] = make([]string, len(g))
+		for j, u := range g {
+			ids[i][j] = u.ID
+		}
+	}
+	return Round{Date: date, Channel: channel, Strategy: strategy, Seed: seed, Groups: ids}
+}
+
+// Encounters returns an encounter for every pair sharing a group in r.
+func (r Round) Encounters() []Encounter {
+	encounters := []Encounter{}
+	for _, g := range r.Groups {
+		for i := 0; i < len(g)-1; i++ {
+			for j := i + 1; j < len(g); j++ {
+				encounters = append(encounters, Encounter{g[i], g[j], r.Date})
+			}
+		}
+	}
+	return encounters
+}
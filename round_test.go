@@ -0,0 +1,31 @@
+package coffeetable
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewRound(t *testing.T) {
+	date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	groups := [][]User{
+		[]User{User{ID: "U1", Name: "ali"}, User{ID: "U2", Name: "veli"}},
+		[]User{User{ID: "U3", Name: "deli"}},
+	}
+	expected := Round{Date: date, Channel: "coffee", Strategy: STRATEGY_RANDOM, Seed: 7, Groups: [][]string{[]string{"U1", "U2"}, []string{"U3"}}}
+	if actual := NewRound(date, "coffee", STRATEGY_RANDOM, 7, groups); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected: %v but was: %v", expected, actual)
+	}
+}
+
+func TestRoundEncounters(t *testing.T) {
+	date := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	groups := [][]User{
+		[]User{slackUser("ali"), slackUser("veli"), slackUser("deli")},
+		[]User{slackUser("can"), slackUser("cem")},
+	}
+	round := NewRound(date, "coffee", STRATEGY_WEIGHTED, 1, groups)
+	if actual, expected := round.Encounters(), NewEncounters(groups, date); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("Expected: %v but was: %v", expected, actual)
+	}
+}
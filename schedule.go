@@ -0,0 +1,108 @@
+package coffeetable
+
+// CircleSchedule is the state of a circle method pairing schedule: the first
+// seat stays fixed and every other seat moves one position each round, so in
+// a cycle of len(Seats)-1 rounds everyone meets everyone else exactly once.
+// Seats holds the user IDs in seat order, an empty ID is a free seat.
+// Round is the number of rounds played since the circle last grew.
+// NewCycle reports whether the last round grew the circle in the middle of a
+// cycle, cutting it short: a bigger circle rotates differently, so its cycle
+// starts over and pairs of the cut cycle may meet again.
+type CircleSchedule struct {
+	Seats    []string
+	Round    int
+	NewCycle bool `json:"-"`
+}
+
+// Next seats the given users and returns the pairs of the coming round. Users
+// who left free their seats and joiners take free seats first, so the cycle
+// carries on for everyone else. When joiners find no free seat the circle
+// grows and a new cycle starts. A user whose partner is missing is paired
+// with another such user or, if there is none, joins the last pair.
+func (s *CircleSchedule) Next(users []User) [][]User {
+	if len(users) == 0 {
+		return [][]User{}
+	}
+	userMap := s.seat(users)
+	groups := [][]User{}
+	alone := []User{}
+	for _, pair := range s.pairs() {
+		u1, ok1 := userMap[s.Seats[pair[0]]]
+		u2, ok2 := userMap[s.Seats[pair[1]]]
+		switch {
+		case ok1 && ok2:
+			groups = append(groups, []User{u1, u2})
+		case ok1:
+			alone = append(alone, u1)
+		case ok2:
+			alone = append(alone, u2)
+		}
+	}
+	for len(alone) > 1 {
+		groups = append(groups, []User{alone[0], alone[1]})
+		alone = alone[2:]
+	}
+	if len(alone) == 1 {
+		if len(groups) == 0 {
+			groups = append(groups, alone)
+		} else {
+			groups[len(groups)-1] = append(groups[len(groups)-1], alone[0])
+		}
+	}
+	s.Round++
+	return groups
+}
+
+func (s *CircleSchedule) seat(users []User) map[string]User {
+	userMap := make(map[string]User)
+	for _, u := range users {
+		userMap[u.ID] = u
+	}
+	seated := make(map[string]bool)
+	for i, name := range s.Seats {
+		if _, ok := userMap[name]; !ok {
+			s.Seats[i] = ""
+		} else {
+			seated[name] = true
+		}
+	}
+	seats := len(s.Seats)
+	free := 0
+	for _, u := range sortUsers(users) {
+		if seated[u.ID] {
+			continue
+		}
+		for free < len(s.Seats) && s.Seats[free] != "" {
+			free++
+		}
+		if free < len(s.Seats) {
+			s.Seats[free] = u.ID
+		} else {
+			s.Seats = append(s.Seats, u.ID)
+		}
+		seated[u.ID] = true
+	}
+	if len(s.Seats)%2 == 1 {
+		s.Seats = append(s.Seats, "")
+	}
+	s.NewCycle = false
+	if len(s.Seats) > seats {
+		s.NewCycle = seats > 0 && s.Round%(seats-1) != 0
+		s.Round = 0
+	}
+	return userMap
+}
+
+// pairs returns the seat indexes meeting in the current round.
+func (s *CircleSchedule) pairs() [][2]int {
+	n := len(s.Seats)
+	order := make([]int, n)
+	for k := 1; k < n; k++ {
+		order[k] = 1 + (k-1+s.Round)%(n-1)
+	}
+	pairs := make([][2]int, n/2)
+	for i := range pairs {
+		pairs[i] = [2]int{order[i], order[n-1-i]}
+	}
+	return pairs
+}
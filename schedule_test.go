@@ -0,0 +1,141 @@
+package coffeetable
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCircleScheduleShouldPairEveryoneOnceBeforeRepeating(t *testing.T) {
+	for _, size := range []int{2, 4, 5, 6, 8, 9} {
+		users := namedUsers(size)
+		s := &CircleSchedule{}
+		met := make(map[string]int)
+		rounds := size - 1
+		if size%2 == 1 {
+			rounds = size
+		}
+		for r := 0; r < rounds; r++ {
+			groups := s.Next(users)
+			checkEveryoneGroupedOnce(t, groups, users)
+			for _, g := range groups {
+				for i := 0; i < len(g)-1; i++ {
+					for j := i + 1; j < len(g); j++ {
+						met[g[i].Name+"|"+g[j].Name]++
+						met[g[j].Name+"|"+g[i].Name]++
+					}
+				}
+			}
+		}
+		for i := 0; i < size; i++ {
+			for j := i + 1; j < size; j++ {
+				c := met[users[i].Name+"|"+users[j].Name]
+				// with an odd roster the user without a partner joins a pair
+				if c != 1 && (size%2 == 0 || c == 0) {
+					t.Fatalf("Size %d, %s and %s should be paired once in a cycle but it was %d times", size, users[i].Name, users[j].Name, c)
+				}
+			}
+		}
+		if s.Round != rounds {
+			t.Fatalf("Size %d, round should be %d but was %d", size, rounds, s.Round)
+		}
+	}
+}
+
+func TestCircleScheduleShouldKeepSeatsWhenRosterChanges(t *testing.T) {
+	users := namedUsers(6)
+	s := &CircleSchedule{}
+	s.Next(users)
+	seats := make([]string, len(s.Seats))
+	copy(seats, s.Seats)
+
+	// u2 leaves, u6 joins and takes the free seat
+	changed := append([]User{slackUser("u6")}, users[:2]...)
+	changed = append(changed, users[3:]...)
+	groups := s.Next(changed)
+	checkEveryoneGroupedOnce(t, groups, changed)
+	seats[2] = "u6"
+	if !reflect.DeepEqual(s.Seats, seats) {
+		t.Fatalf("Expected seats: %v but was: %v", seats, s.Seats)
+	}
+
+	// u5 leaves without replacement, its partner should not be left alone
+	groups = s.Next(changed[:len(changed)-1])
+	checkEveryoneGroupedOnce(t, groups, changed[:len(changed)-1])
+	if s.Seats[5] != "" {
+		t.Fatalf("Seat of u5 should be free but was: %v", s.Seats)
+	}
+
+	// two more users join, one fills the free seat and the circle grows
+	more := append(changed, slackUser("u7"), slackUser("u8"))
+	groups = s.Next(more)
+	checkEveryoneGroupedOnce(t, groups, more)
+	if len(s.Seats) != 8 || s.Round != 1 || !s.NewCycle {
+		t.Fatalf("8 seats at round 1 of a new cycle expected but it was: %v", s)
+	}
+}
+
+func TestCircleScheduleShouldStartNewCycleWhenCircleGrows(t *testing.T) {
+	users := namedUsers(8)
+	s := &CircleSchedule{}
+	for r := 0; r < 2; r++ {
+		s.Next(users[:6])
+		if s.NewCycle {
+			t.Fatalf("Round %d should not start a new cycle", r+1)
+		}
+	}
+	met := make(map[string]int)
+	for r := 0; r < 7; r++ {
+		groups := s.Next(users)
+		if s.NewCycle != (r == 0) {
+			t.Fatalf("Only the round the circle grows should start a new cycle, round %d: %v", r+1, s)
+		}
+		for _, g := range groups {
+			pair := g[0].Name + "|" + g[1].Name
+			if met[pair]++; met[pair] > 1 {
+				t.Fatalf("%s should not meet twice in a cycle, round %d: %v", pair, r+1, userGroupNames(groups))
+			}
+			met[g[1].Name+"|"+g[0].Name]++
+		}
+	}
+	if len(met) != 8*7 {
+		t.Fatalf("Everyone should meet everyone in the cycle but pairs were: %v", met)
+	}
+}
+
+func TestCircleScheduleWithSingleUser(t *testing.T) {
+	s := &CircleSchedule{}
+	groups := s.Next([]User{slackUser("ali")})
+	if len(groups) != 1 || len(groups[0]) != 1 {
+		t.Fatalf("Single group with ali expected but was: %v", userGroupNames(groups))
+	}
+	if groups := s.Next([]User{}); len(groups) != 0 {
+		t.Fatalf("No groups expected but was: %v", userGroupNames(groups))
+	}
+}
+
+func checkEveryoneGroupedOnce(t *testing.T, groups [][]User, users []User) {
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		if len(g) < 2 || len(g) > 3 {
+			t.Fatalf("Groups should be pairs or a trio but it was: %v", userGroupNames(groups))
+		}
+		for _, u := range g {
+			if seen[u.Name] {
+				t.Fatalf("%s is grouped twice: %v", u.Name, userGroupNames(groups))
+			}
+			seen[u.Name] = true
+		}
+	}
+	if len(seen) != len(users) {
+		t.Fatalf("Every user should be grouped once: %v", userGroupNames(groups))
+	}
+}
+
+func namedUsers(size int) []User {
+	users := make([]User, size)
+	for i := range users {
+		users[i] = slackUser(fmt.Sprintf("u%d", i))
+	}
+	return users
+}
@@ -1,38 +1,50 @@
 package slackhelper
 
-import "github.com/nlopes/slack"
+import (
+	"context"
+
+	"github.com/nlopes/slack"
+)
+
+// MEMBERS_PAGE_SIZE is the number of channel members asked for at once.
+const MEMBERS_PAGE_SIZE = 200
 
 type slackAdapter interface {
-	GetChannelMembers(channel string) ([]string, error)
-	GetGroupMembers(group string) ([]string, error)
-	GetUserInfo(user string) (*slack.User, error)
-	PostMessage(channel string, text string, params slack.PostMessageParameters) (string, string, error)
+	GetConversationMembers(ctx context.Context, channel string, cursor string) ([]string, string, error)
+	GetUsers(ctx context.Context) ([]slack.User, error)
+	PostMessage(ctx context.Context, channel string, text string, blocks []slack.Block, params slack.PostMessageParameters) (string, string, error)
+	DeleteMessage(ctx context.Context, channel string, ts string) (string, string, error)
 }
 
 type realSlackAdapter struct {
 	api *slack.Client
 }
 
-func (r *realSlackAdapter) GetChannelMembers(channel string) ([]string, error) {
-	info, err := r.api.GetChannelInfo(channel)
-	if err != nil {
-		return nil, err
-	}
-	return info.Members, nil
+// GetConversationMembers returns a page of the members of a public, private
+// or shared channel and the cursor of the next page, empty on the last page.
+func (r *realSlackAdapter) GetConversationMembers(ctx context.Context, channel string, cursor string) ([]string, string, error) {
+	return r.api.GetUsersInConversationContext(ctx, &slack.GetUsersInConversationParameters{
+		ChannelID: channel,
+		Cursor:    cursor,
+		Limit:     MEMBERS_PAGE_SIZE,
+	})
 }
 
-func (r *realSlackAdapter) GetGroupMembers(group string) ([]string, error) {
-	info, err := r.api.GetGroupInfo(group)
-	if err != nil {
-		return nil, err
-	}
-	return info.Members, nil
+// GetUsers returns all users of the workspace, paging through users.list.
+func (r *realSlackAdapter) GetUsers(ctx context.Context) ([]slack.User, error) {
+	return r.api.GetUsersContext(ctx)
 }
 
-func (r *realSlackAdapter) GetUserInfo(user string) (*slack.User, error) {
-	return r.api.GetUserInfo(user)
+// PostMessage posts text, or blocks with text as the fallback of clients
+// that can't render them.
+func (r *realSlackAdapter) PostMessage(ctx context.Context, channel string, text string, blocks []slack.Block, params slack.PostMessageParameters) (string, string, error) {
+	options := []slack.MsgOption{slack.MsgOptionText(text, false), slack.MsgOptionPostMessageParameters(params)}
+	if len(blocks) > 0 {
+		options = append(options, slack.MsgOptionBlocks(blocks...))
+	}
+	return r.api.PostMessageContext(ctx, channel, options...)
 }
 
-func (r *realSlackAdapter) PostMessage(channel string, text string, params slack.PostMessageParameters) (string, string, error) {
-	return r.api.PostMessage(channel, slack.MsgOptionText(text, false), slack.MsgOptionPostMessageParameters(params))
+func (r *realSlackAdapter) DeleteMessage(ctx context.Context, channel string, ts string) (string, string, error) {
+	return r.api.DeleteMessageContext(ctx, channel, ts)
 }
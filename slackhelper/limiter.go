@@ -0,0 +1,112 @@
+package slackhelper
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	// MAX_CONCURRENT_CALLS caps the Slack calls running at once.
+	MAX_CONCURRENT_CALLS = 4
+	// MAX_RETRIES is how many times a rate limited or failing call is retried.
+	MAX_RETRIES = 5
+	// RETRY_BACKOFF is the wait before the first retry of a transient error,
+	// doubled on every retry.
+	RETRY_BACKOFF = time.Second
+)
+
+// limiter wraps an adapter so that a few calls run at once, rate limited
+// calls wait as long as Slack asks, transient errors of reading calls are
+// retried with exponential backoff, and no call or wait outlives its context.
+// Posting or deleting a message that failed may still have gone through, so
+// those are retried only when Slack rate limited them.
+type limiter struct {
+	adapter slackAdapter
+	slots   chan struct{}
+	retries int
+	backoff time.Duration
+}
+
+func newLimiter(adapter slackAdapter, concurrency int, retries int, backoff time.Duration) *limiter {
+	return &limiter{adapter, make(chan struct{}, concurrency), retries, backoff}
+}
+
+func (l *limiter) do(ctx context.Context, idempotent bool, call func(ctx context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		err := call(ctx)
+		<-l.slots
+		if err == nil || attempt == l.retries {
+			return err
+		}
+		wait, ok := retryWait(err, idempotent, l.backoff<<uint(attempt))
+		if !ok {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// retryWait returns how long to wait before retrying a call failing with
+// err, and whether it should be retried at all. Only a rate limited call is
+// retried unless the call is idempotent.
+func retryWait(err error, idempotent bool, backoff time.Duration) (time.Duration, bool) {
+	if rateLimited, ok := err.(*slack.RateLimitedError); ok {
+		return rateLimited.RetryAfter, true
+	}
+	if !idempotent {
+		return 0, false
+	}
+	if retryable, ok := err.(interface{ Retryable() bool }); ok && retryable.Retryable() {
+		return backoff, true
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return backoff, true
+	}
+	return 0, false
+}
+
+func (l *limiter) GetConversationMembers(ctx context.Context, channel string, cursor string) (members []string, next string, err error) {
+	err = l.do(ctx, true, func(ctx context.Context) (err error) {
+		members, next, err = l.adapter.GetConversationMembers(ctx, channel, cursor)
+		return
+	})
+	return
+}
+
+func (l *limiter) GetUsers(ctx context.Context) (users []slack.User, err error) {
+	err = l.do(ctx, true, func(ctx context.Context) (err error) {
+		users, err = l.adapter.GetUsers(ctx)
+		return
+	})
+	return
+}
+
+func (l *limiter) PostMessage(ctx context.Context, channel string, text string, blocks []slack.Block, params slack.PostMessageParameters) (respChannel string, ts string, err error) {
+	err = l.do(ctx, false, func(ctx context.Context) (err error) {
+		respChannel, ts, err = l.adapter.PostMessage(ctx, channel, text, blocks, params)
+		return
+	})
+	return
+}
+
+func (l *limiter) DeleteMessage(ctx context.Context, channel string, ts string) (respChannel string, respTs string, err error) {
+	err = l.do(ctx, false, func(ctx context.Context) (err error) {
+		respChannel, respTs, err = l.adapter.DeleteMessage(ctx, channel, ts)
+		return
+	})
+	return
+}
@@ -0,0 +1,136 @@
+package slackhelper
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+type retryableError struct{}
+
+func (retryableError) Error() string   { return "internal_error" }
+func (retryableError) Retryable() bool { return true }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestLimiterShouldRetryRateLimitedAndTransientErrors(t *testing.T) {
+	tableTest := []struct {
+		errs     []error
+		calls    int
+		expected error
+	}{
+		{[]error{&slack.RateLimitedError{RetryAfter: time.Millisecond}}, 2, nil},
+		{[]error{retryableError{}, retryableError{}}, 3, nil},
+		{[]error{errors.New("channel_not_found")}, 1, errors.New("channel_not_found")},
+		{[]error{retryableError{}, retryableError{}, retryableError{}}, 3, retryableError{}},
+	}
+	for i, test := range tableTest {
+		calls := 0
+		mock := &mockSlack{
+			getUsers: func(context.Context) ([]slack.User, error) {
+				calls++
+				if calls <= len(test.errs) {
+					return nil, test.errs[calls-1]
+				}
+				return []slack.User{slack.User{ID: "ali"}}, nil
+			},
+		}
+		users, err := newLimiter(mock, 1, 2, time.Millisecond).GetUsers(context.Background())
+		if calls != test.calls {
+			t.Fatalf("Test %d, expected %d calls but was: %d", i+1, test.calls, calls)
+		}
+		if test.expected == nil && (err != nil || len(users) != 1) {
+			t.Fatalf("Test %d, expected users but was: %v error: %v", i+1, users, err)
+		}
+		if test.expected != nil && (err == nil || err.Error() != test.expected.Error()) {
+			t.Fatalf("Test %d, expected error: %v but was: %v", i+1, test.expected, err)
+		}
+	}
+}
+func TestLimiterShouldRetryPostingOnlyWhenRateLimited(t *testing.T) {
+	tableTest := []struct {
+		err   error
+		calls int
+	}{
+		{&slack.RateLimitedError{RetryAfter: time.Millisecond}, 2},
+		{retryableError{}, 1},
+		{timeoutError{}, 1},
+	}
+	for i, test := range tableTest {
+		calls := 0
+		mock := &mockSlack{
+			postMessage: func(ctx context.Context, channel string, text string, blocks []slack.Block, params slack.PostMessageParameters) (string, string, error) {
+				calls++
+				if calls == 1 {
+					return "", "", test.err
+				}
+				return channel, "1571400000.000200", nil
+			},
+		}
+		newLimiter(mock, 1, 2, time.Millisecond).PostMessage(context.Background(), "channel", "groups", nil, slack.PostMessageParameters{})
+		if calls != test.calls {
+			t.Fatalf("Test %d, expected %d calls but was: %d", i+1, test.calls, calls)
+		}
+	}
+}
+func TestLimiterShouldStopWaitingAtDeadline(t *testing.T) {
+	calls := 0
+	mock := &mockSlack{
+		deleteMessage: func(ctx context.Context, channel string, ts string) (string, string, error) {
+			calls++
+			return "", "", &slack.RateLimitedError{RetryAfter: time.Hour}
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := newLimiter(mock, 1, MAX_RETRIES, time.Millisecond).DeleteMessage(ctx, "channel", "1571400000.000200")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Deadline error expected but was: %v", err)
+	}
+	if calls != 1 || time.Since(start) > time.Second {
+		t.Fatalf("Limiter should give up at the deadline, calls: %d took: %v", calls, time.Since(start))
+	}
+}
+func TestLimiterShouldCapConcurrentCalls(t *testing.T) {
+	mu := sync.Mutex{}
+	running, max := 0, 0
+	mock := &mockSlack{
+		getConversationMembers: func(ctx context.Context, channel string, cursor string) ([]string, string, error) {
+			mu.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return []string{"ali"}, "", nil
+		},
+	}
+	l := newLimiter(mock, 2, 0, time.Millisecond)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := l.GetConversationMembers(context.Background(), "channel", ""); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if max > 2 {
+		t.Fatalf("2 calls at once expected at most but was: %d", max)
+	}
+}
@@ -1,82 +1,260 @@
 package slackhelper
 
 import (
+	"context"
 	"fmt"
 	"strings"
-	"sync"
+	"time"
 
 	ct "github.com/mtyurt/coffeetable"
 
 	"github.com/nlopes/slack"
 )
 
+// SlackHelper talks to Slack through a limiter, every call gives up when
+// its context is done.
 type SlackHelper interface {
-	GetChannelMembers() ([]ct.User, error)
-	PublishGroupsInSlack(gorups [][]ct.User) error
+	GetChannelMembers(ctx context.Context) ([]ct.User, error)
+	PublishGroupsInSlack(ctx context.Context, gorups [][]ct.User, announcement Announcement) (string, error)
+	DeleteMessage(ctx context.Context, ts string) error
+}
+
+const (
+	// FORMAT_BLOCKS announces groups in Block Kit sections with a plain text
+	// fallback.
+	FORMAT_BLOCKS = "blocks"
+	// FORMAT_TEXT announces groups in plain text.
+	FORMAT_TEXT = "text"
+	// MAX_CONTEXT_ELEMENTS is the most elements Slack takes in a context block.
+	MAX_CONTEXT_ELEMENTS = 10
+	// MAX_BLOCKS is the most blocks Slack takes in a message.
+	MAX_BLOCKS = 50
+	// MBT_HEADER is the type of a header block, the slack package has no
+	// header block yet.
+	MBT_HEADER slack.MessageBlockType = "header"
+)
+
+// headerBlock is a header block, a line of large plain text.
+type headerBlock struct {
+	Type slack.MessageBlockType `json:"type"`
+	Text *slack.TextBlockObject `json:"text"`
+}
+
+func newHeaderBlock(text string) *headerBlock {
+	return &headerBlock{MBT_HEADER, slack.NewTextBlockObject(slack.PlainTextType, text, false, false)}
+}
+func (b *headerBlock) BlockType() slack.MessageBlockType {
+	return b.Type
+}
+
+// Announcement is how the groups are announced. Context is an optional
+// line like the meeting link or an icebreaker.
+type Announcement struct {
+	Format  string
+	Context string
+}
+
+// UserCache keeps the users of the workspace between runs.
+type UserCache interface {
+	GetUserCache() ([]ct.User, time.Time, error)
+	SaveUserCache(users []ct.User, fetchedAt time.Time) error
 }
 
 type slackService struct {
 	token       string
 	channel     string
-	isPrivate   bool
 	apiProvider func(token string) slackAdapter
+	cache       UserCache
+	cacheTTL    time.Duration
+	now         func() time.Time
+}
+
+func New(token string, channel string) SlackHelper {
+	return NewWithCache(token, channel, nil, 0)
 }
 
-func New(token string, channel string, isPrivate bool) SlackHelper {
-	return &slackService{token, channel, isPrivate, func(t string) slackAdapter {
-		return &realSlackAdapter{slack.New(t)}
-	}}
+// NewWithCache returns a helper reading the users of the workspace from
+// cache while they are younger than ttl.
+func NewWithCache(token string, channel string, cache UserCache, ttl time.Duration) SlackHelper {
+	api := newLimiter(&realSlackAdapter{slack.New(token)}, MAX_CONCURRENT_CALLS, MAX_RETRIES, RETRY_BACKOFF)
+	return &slackService{
+		token:   token,
+		channel: channel,
+		apiProvider: func(string) slackAdapter {
+			return api
+		},
+		cache:    cache,
+		cacheTTL: ttl,
+		now:      time.Now,
+	}
 }
-func (service *slackService) GetChannelMembers() (members []ct.User, err error) {
+
+// GetChannelMembers returns the channel members who are neither deleted nor
+// bots, in channel order. Members missing from cached users are looked up
+// in a fresh user list.
+func (service *slackService) GetChannelMembers(ctx context.Context) (members []ct.User, err error) {
 	slackApi := service.apiProvider(service.token)
-	var ids []string
-	if !service.isPrivate {
-		ids, err = slackApi.GetChannelMembers(service.channel)
+	ids := []string{}
+	cursor := ""
+	for {
+		var page []string
+		page, cursor, err = slackApi.GetConversationMembers(ctx, service.channel, cursor)
 		if err != nil {
 			return nil, err
 		}
-	} else {
-		ids, err = slackApi.GetGroupMembers(service.channel)
-		if err != nil {
-			return nil, err
+		ids = append(ids, page...)
+		if cursor == "" {
+			break
 		}
 	}
-	members = []ct.User{}
-	wg := sync.WaitGroup{}
-	mu := sync.Mutex{}
-	wg.Add(len(ids))
+	users, cached, err := service.users(ctx, slackApi, false)
+	if err != nil {
+		return nil, err
+	}
 	for _, id := range ids {
-		//9 seconds improvement
-		go func(id string) {
-			userinfo, err := slackApi.GetUserInfo(id)
-			if err != nil {
-				panic(err)
-			}
-			if !userinfo.Deleted && !userinfo.IsBot {
-				mu.Lock()
-				members = append(members, ct.User(*userinfo))
-				mu.Unlock()
+		if _, ok := users[id]; !ok && cached {
+			if users, _, err = service.users(ctx, slackApi, true); err != nil {
+				return nil, err
 			}
-			wg.Done()
-		}(id)
+			break
+		}
+	}
+	members = []ct.User{}
+	for _, id := range ids {
+		u, ok := users[id]
+		if ok && !u.Deleted && !u.IsBot {
+			members = append(members, u)
+		}
 	}
-	wg.Wait()
 	return
 }
 
-func (service *slackService) PublishGroupsInSlack(groups [][]ct.User) error {
+// users returns the users of the workspace by ID from the cache, unless it
+// is stale or fresh users are asked for, and reports whether they are cached.
+func (service *slackService) users(ctx context.Context, slackApi slackAdapter, fresh bool) (map[string]ct.User, bool, error) {
+	now := service.now()
+	if service.cache != nil && !fresh {
+		cached, fetchedAt, err := service.cache.GetUserCache()
+		if err != nil {
+			return nil, false, err
+		}
+		if len(cached) > 0 && now.Sub(fetchedAt) < service.cacheTTL {
+			return usersByID(cached), true, nil
+		}
+	}
+	list, err := slackApi.GetUsers(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	users := make([]ct.User, len(list))
+	for i, u := range list {
+		users[i] = ct.User(u)
+	}
+	if service.cache != nil {
+		if err = service.cache.SaveUserCache(users, now); err != nil {
+			return nil, false, err
+		}
+	}
+	return usersByID(users), false, nil
+}
+func usersByID(users []ct.User) map[string]ct.User {
+	byID := make(map[string]ct.User)
+	for _, u := range users {
+		byID[u.ID] = u
+	}
+	return byID
+}
+
+// PublishGroupsInSlack announces the groups in the channel and returns the
+// timestamp of the message. Blocks are the default format, the text is
+// posted along with them for clients that can't render blocks.
+func (service *slackService) PublishGroupsInSlack(ctx context.Context, groups [][]ct.User, announcement Announcement) (string, error) {
+	var blocks []slack.Block
+	switch announcement.Format {
+	case "", FORMAT_BLOCKS:
+		blocks = groupBlocks(groups, announcement)
+	case FORMAT_TEXT:
+	default:
+		return "", fmt.Errorf("Announcement format %s is not valid!", announcement.Format)
+	}
 	slackApi := service.apiProvider(service.token)
+	params := slack.PostMessageParameters{
+		AsUser: true,
+	}
+	_, ts, err := slackApi.PostMessage(ctx, service.channel, groupText(groups, announcement), blocks, params)
+	return ts, err
+}
+
+func groupText(groups [][]ct.User, announcement Announcement) string {
 	text := ""
 	for i, group := range groups {
-		ids := make([]string, len(group))
-		for j, u := range group {
-			ids[j] = fmt.Sprintf("<@%s>", u.ID)
+		text += fmt.Sprintf("*Group %d:* %v\n", i+1, mentions(group))
+	}
+	footer := "Zoom up!"
+	if announcement.Context != "" {
+		footer = announcement.Context
+	}
+	return fmt.Sprintf("Coffee time! Today's groups: \n%s\n%s", text, footer)
+}
+
+// groupBlocks returns a header, a section of mentions per group followed by
+// the avatars of the group, and the context line if there is one. Avatars
+// are left out when the blocks would pass MAX_BLOCKS, and no blocks are
+// returned, leaving the plain text, when the sections still would.
+func groupBlocks(groups [][]ct.User, announcement Announcement) []slack.Block {
+	blocks := buildGroupBlocks(groups, announcement, true)
+	if len(blocks) > MAX_BLOCKS {
+		blocks = buildGroupBlocks(groups, announcement, false)
+	}
+	if len(blocks) > MAX_BLOCKS {
+		return nil
+	}
+	return blocks
+}
+func buildGroupBlocks(groups [][]ct.User, announcement Announcement, withAvatars bool) []slack.Block {
+	blocks := []slack.Block{
+		newHeaderBlock("Coffee time! Today's groups:"),
+	}
+	for i, group := range groups {
+		text := slack.NewTextBlockObject(slack.MarkdownType, fmt.Sprintf("*Group %d:* %v", i+1, mentions(group)), false, false)
+		blocks = append(blocks, slack.NewSectionBlock(text, nil, nil))
+		if !withAvatars {
+			continue
+		}
+		avatars := []slack.MixedElement{}
+		for _, u := range group {
+			if u.Profile.Image48 != "" && len(avatars) < MAX_CONTEXT_ELEMENTS {
+				avatars = append(avatars, slack.NewImageBlockElement(u.Profile.Image48, userName(u)))
+			}
+		}
+		if len(avatars) > 0 {
+			blocks = append(blocks, slack.NewContextBlock("", avatars...))
 		}
-		text += fmt.Sprintf("*Group %d:* %v\n", i+1, strings.Join(ids, ", "))
 	}
-	params := slack.PostMessageParameters{
-		AsUser: true,
+	if announcement.Context != "" {
+		blocks = append(blocks, slack.NewDividerBlock(), slack.NewContextBlock("", slack.NewTextBlockObject(slack.MarkdownType, announcement.Context, false, false)))
+	}
+	return blocks
+}
+func mentions(group []ct.User) string {
+	ids := make([]string, len(group))
+	for i, u := range group {
+		ids[i] = fmt.Sprintf("<@%s>", u.ID)
+	}
+	return strings.Join(ids, ", ")
+}
+func userName(u ct.User) string {
+	if u.RealName != "" {
+		return u.RealName
+	}
+	if u.Name != "" {
+		return u.Name
 	}
-	_, _, err := slackApi.PostMessage(service.channel, fmt.Sprintf("Coffee time! Today's groups: \n%s\nZoom up!", text), params)
+	return u.ID
+}
+
+// DeleteMessage deletes the message with the given timestamp in the channel.
+func (service *slackService) DeleteMessage(ctx context.Context, ts string) error {
+	_, _, err := service.apiProvider(service.token).DeleteMessage(ctx, service.channel, ts)
 	return err
 }
@@ -1,9 +1,13 @@
 package slackhelper
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	ct "github.com/mtyurt/coffeetable"
 	"github.com/nlopes/slack"
@@ -13,18 +17,17 @@ func TestNew(t *testing.T) {
 	tableTest := []struct {
 		token   string
 		channel string
-		private bool
 	}{
-		{"token", "channel", true},
-		{"123token", "chaadfnnel", false},
+		{"token", "channel"},
+		{"123token", "chaadfnnel"},
 	}
 	for i, test := range tableTest {
-		actual := New(test.token, test.channel, test.private)
+		actual := New(test.token, test.channel)
 		s, ok := actual.(*slackService)
 		if !ok {
 			t.Fatalf("Test %d, Expected service type is: slackService but it was:%v", i+1, reflect.TypeOf(actual))
 		}
-		if s.token != test.token || s.channel != test.channel || s.isPrivate != test.private {
+		if s.token != test.token || s.channel != test.channel {
 			t.Fatalf("Test %d, Expected service: %v but was: %v", i+1, test, s)
 		}
 	}
@@ -32,105 +35,284 @@ func TestNew(t *testing.T) {
 }
 
 func TestGetChannelMembers(t *testing.T) {
-	names := []string{"ali", "veli"}
+	pages := map[string][]string{"": []string{"veli", "bot"}, "page2": []string{"ali", "gone"}}
+	cursors := []string{}
 	mock := &mockSlack{
-		getChannelMembers: func(channel string) ([]string, error) {
-			panic("shouldn't have called")
-		},
-		getGroupMembers: func(group string) ([]string, error) {
-			return names, nil
-		},
-		getUserInfo: func(user string) (*slack.User, error) {
-			switch user {
-			case "ali":
-				return &slack.User{Name: "ali"}, nil
-			case "veli":
-				return &slack.User{Name: "veli"}, nil
-			default:
-				panic(user + " is not valid")
+		getConversationMembers: func(ctx context.Context, channel string, cursor string) ([]string, string, error) {
+			if channel != "channel" {
+				panic(channel + " is not valid")
+			}
+			cursors = append(cursors, cursor)
+			if cursor == "" {
+				return pages[cursor], "page2", nil
 			}
+			return pages[cursor], "", nil
+		},
+		getUsers: func(context.Context) ([]slack.User, error) {
+			return []slack.User{
+				slack.User{ID: "ali", Name: "ali"},
+				slack.User{ID: "veli", Name: "veli"},
+				slack.User{ID: "can", Name: "can"},
+				slack.User{ID: "bot", Name: "bot", IsBot: true},
+				slack.User{ID: "gone", Name: "gone", Deleted: true},
+			}, nil
 		},
 	}
-	slackService := &slackService{"token", "channel", true, func(token string) slackAdapter {
+	slackService := &slackService{token: "token", channel: "channel", apiProvider: func(token string) slackAdapter {
 		return mock
-	}}
+	}, now: time.Now}
 
-	members, err := slackService.GetChannelMembers()
+	members, err := slackService.GetChannelMembers(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	for i, u := range members {
-		if u.Name != names[i] {
-			t.Errorf("%d element expected %s but was %s", i, u.Name, names[i])
+	if !reflect.DeepEqual(cursors, []string{"", "page2"}) {
+		t.Fatalf("Every page should be fetched once, cursors were: %v", cursors)
+	}
+	if names := userNames(members); !reflect.DeepEqual(names, []string{"veli", "ali"}) {
+		t.Fatalf("Channel members except bots and deleted users expected in channel order but was: %v", names)
+	}
+}
+func TestGetChannelMembersShouldReturnErrors(t *testing.T) {
+	mock := &mockSlack{
+		getConversationMembers: func(ctx context.Context, channel string, cursor string) ([]string, string, error) {
+			if cursor == "" {
+				return []string{"ali"}, "page2", nil
+			}
+			return nil, "", errors.New("channel_not_found")
+		},
+		getUsers: func(context.Context) ([]slack.User, error) {
+			return nil, errors.New("ratelimited")
+		},
+	}
+	slackService := &slackService{token: "token", channel: "channel", apiProvider: func(token string) slackAdapter {
+		return mock
+	}, now: time.Now}
+	if _, err := slackService.GetChannelMembers(context.Background()); err == nil || err.Error() != "channel_not_found" {
+		t.Fatalf("Error of a page should be returned but was: %v", err)
+	}
+	mock.getConversationMembers = func(ctx context.Context, channel string, cursor string) ([]string, string, error) {
+		return []string{"ali"}, "", nil
+	}
+	if _, err := slackService.GetChannelMembers(context.Background()); err == nil || err.Error() != "ratelimited" {
+		t.Fatalf("Error of the user list should be returned but was: %v", err)
+	}
+}
+func TestGetChannelMembersShouldUseUserCache(t *testing.T) {
+	now := time.Date(2019, 10, 18, 10, 0, 0, 0, time.UTC)
+	channel, roster := []string{}, []string{}
+	fetches := 0
+	mock := &mockSlack{
+		getConversationMembers: func(context.Context, string, string) ([]string, string, error) {
+			return channel, "", nil
+		},
+		getUsers: func(context.Context) ([]slack.User, error) {
+			fetches++
+			users := []slack.User{}
+			for _, name := range roster {
+				users = append(users, slack.User{ID: name, Name: name})
+			}
+			return users, nil
+		},
+	}
+	cache := &mockCache{}
+	slackService := &slackService{token: "token", channel: "channel", apiProvider: func(token string) slackAdapter {
+		return mock
+	}, cache: cache, cacheTTL: time.Hour, now: func() time.Time { return now }}
+
+	tableTest := []struct {
+		channel []string
+		roster  []string
+		now     time.Time
+		fetches int
+		members []string
+	}{
+		// empty cache
+		{[]string{"ali", "veli"}, []string{"ali", "veli"}, now, 1, []string{"ali", "veli"}},
+		// fresh cache
+		{[]string{"ali", "veli"}, []string{"ali", "veli", "can"}, now.Add(30 * time.Minute), 1, []string{"ali", "veli"}},
+		// member missing from the cache
+		{[]string{"ali", "can"}, []string{"ali", "veli", "can"}, now.Add(40 * time.Minute), 2, []string{"ali", "can"}},
+		// stale cache
+		{[]string{"veli"}, []string{"veli"}, now.Add(2 * time.Hour), 3, []string{"veli"}},
+	}
+	for i, test := range tableTest {
+		channel, roster = test.channel, test.roster
+		slackService.now = func() time.Time { return test.now }
+		members, err := slackService.GetChannelMembers(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fetches != test.fetches || !reflect.DeepEqual(userNames(members), test.members) {
+			t.Fatalf("Test %d, expected %d fetches and members: %v but was %d fetches and members: %v", i+1, test.fetches, test.members, fetches, userNames(members))
 		}
+		if len(cache.users) == 0 || cache.fetchedAt.After(test.now) {
+			t.Fatalf("Test %d, users should be cached but cache was: %v fetched at: %v", i+1, cache.users, cache.fetchedAt)
+		}
+	}
+}
+func userNames(users []ct.User) []string {
+	names := []string{}
+	for _, u := range users {
+		names = append(names, u.Name)
 	}
+	return names
+}
 
-	// test non-private
+type mockCache struct {
+	users     []ct.User
+	fetchedAt time.Time
+}
 
-	mock.getChannelMembers = func(channel string) ([]string, error) {
-		return names, nil
+func (m *mockCache) GetUserCache() ([]ct.User, time.Time, error) {
+	return m.users, m.fetchedAt, nil
+}
+func (m *mockCache) SaveUserCache(users []ct.User, fetchedAt time.Time) error {
+	m.users, m.fetchedAt = users, fetchedAt
+	return nil
+}
+func TestPublishGroupsInSlack(t *testing.T) {
+	groups := [][]ct.User{
+		[]ct.User{ct.User{ID: "ali", RealName: "Ali", Profile: slack.UserProfile{Image48: "https://avatars/ali.png"}}, ct.User{ID: "veli"}},
 	}
-	mock.getGroupMembers = func(group string) ([]string, error) {
-		panic("shouldn't have called")
+	tableTest := []struct {
+		announcement Announcement
+		text         string
+		blockTypes   []slack.MessageBlockType
+	}{
+		{Announcement{Format: FORMAT_TEXT}, "Coffee time! Today's groups: \n*Group 1:* <@ali>, <@veli>\n\nZoom up!", nil},
+		{Announcement{}, "Coffee time! Today's groups: \n*Group 1:* <@ali>, <@veli>\n\nZoom up!",
+			[]slack.MessageBlockType{MBT_HEADER, slack.MBTSection, slack.MBTContext}},
+		{Announcement{Format: FORMAT_BLOCKS, Context: "Meet at zoom"}, "Coffee time! Today's groups: \n*Group 1:* <@ali>, <@veli>\n\nMeet at zoom",
+			[]slack.MessageBlockType{MBT_HEADER, slack.MBTSection, slack.MBTContext, slack.MBTDivider, slack.MBTContext}},
 	}
-	slackService.isPrivate = false
-	members, err = slackService.GetChannelMembers()
+	for i, test := range tableTest {
+		var inputChannel, inputText string
+		var inputBlocks []slack.Block
+		mock := &mockSlack{
+			postMessage: func(ctx context.Context, channel string, text string, blocks []slack.Block, params slack.PostMessageParameters) (string, string, error) {
+				inputChannel, inputText, inputBlocks = channel, text, blocks
+				return channel, "1571400000.000200", nil
+			},
+		}
+		slackService := &slackService{token: "token", channel: "mychannel", apiProvider: func(token string) slackAdapter {
+			return mock
+		}}
+		ts, err := slackService.PublishGroupsInSlack(context.Background(), groups, test.announcement)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts != "1571400000.000200" {
+			t.Fatalf("Test %d, message timestamp is expected: 1571400000.000200 but was: %s", i+1, ts)
+		}
+		if inputChannel != "mychannel" {
+			t.Fatalf("Test %d, channel is expected: mychannel but was: %s", i+1, inputChannel)
+		}
+		if inputText != test.text {
+			t.Fatalf("Test %d, text is exptected to be: %s but was: %s", i+1, test.text, inputText)
+		}
+		blockTypes := []slack.MessageBlockType(nil)
+		for _, b := range inputBlocks {
+			blockTypes = append(blockTypes, b.BlockType())
+		}
+		if !reflect.DeepEqual(blockTypes, test.blockTypes) {
+			t.Fatalf("Test %d, blocks expected: %v but was: %v", i+1, test.blockTypes, blockTypes)
+		}
+	}
+}
+func TestGroupBlocksShouldMentionMembersWithAvatars(t *testing.T) {
+	blocks := groupBlocks([][]ct.User{
+		[]ct.User{ct.User{ID: "ali", RealName: "Ali", Profile: slack.UserProfile{Image48: "https://avatars/ali.png"}}, ct.User{ID: "veli"}},
+	}, Announcement{})
+	header, err := json.Marshal(blocks[0])
 	if err != nil {
 		t.Fatal(err)
 	}
-	for i, u := range members {
-		if u.Name != names[i] {
-			t.Errorf("%d element expected %s but was %s", i, u.Name, names[i])
+	if string(header) != `{"type":"header","text":{"type":"plain_text","text":"Coffee time! Today's groups:"}}` {
+		t.Fatalf("Header block expected but was: %s", header)
+	}
+	section := blocks[1].(*slack.SectionBlock)
+	if section.Text.Text != "*Group 1:* <@ali>, <@veli>" {
+		t.Fatalf("Group section should mention its members but was: %s", section.Text.Text)
+	}
+	avatars := blocks[2].(*slack.ContextBlock).ContextElements.Elements
+	if len(avatars) != 1 {
+		t.Fatalf("Only members with avatars should have one but was: %v", avatars)
+	}
+	if image := avatars[0].(*slack.ImageBlockElement); image.ImageURL != "https://avatars/ali.png" || image.AltText != "Ali" {
+		t.Fatalf("Avatar of ali expected but was: %v", image)
+	}
+}
+func TestGroupBlocksShouldStayWithinTheBlockLimit(t *testing.T) {
+	tableTest := []struct {
+		groups   int
+		expected int
+	}{
+		{23, 1 + 2*23 + 2},
+		{25, 1 + 25 + 2},
+		{47, 1 + 47 + 2},
+		{48, 0},
+	}
+	for i, test := range tableTest {
+		groups := make([][]ct.User, test.groups)
+		for j := range groups {
+			groups[j] = []ct.User{ct.User{ID: fmt.Sprintf("U%d", j), Profile: slack.UserProfile{Image48: "https://avatars/u.png"}}}
+		}
+		blocks := groupBlocks(groups, Announcement{Context: "Zoom up!"})
+		if len(blocks) != test.expected {
+			t.Fatalf("Test %d, %d blocks expected but was: %d", i+1, test.expected, len(blocks))
+		}
+		if len(blocks) > MAX_BLOCKS {
+			t.Fatalf("Test %d, blocks should not pass %d but was: %d", i+1, MAX_BLOCKS, len(blocks))
 		}
 	}
 }
-func TestPublishGroupsInSlack(t *testing.T) {
-	var inputChannel, inputText string
+func TestPublishGroupsInSlackShouldFailForUnknownFormat(t *testing.T) {
+	slackService := &slackService{token: "token", channel: "mychannel", apiProvider: func(token string) slackAdapter {
+		return &mockSlack{}
+	}}
+	if _, err := slackService.PublishGroupsInSlack(context.Background(), nil, Announcement{Format: "html"}); err == nil {
+		t.Fatal("Unknown announcement format should fail")
+	}
+}
+func TestDeleteMessage(t *testing.T) {
+	var inputChannel, inputTs string
 	mock := &mockSlack{
-		postMessage: func(channel string, text string, params slack.PostMessageParameters) (string, string, error) {
-			inputChannel = channel
-			inputText = text
-			return "", "", nil
+		deleteMessage: func(ctx context.Context, channel string, ts string) (string, string, error) {
+			inputChannel, inputTs = channel, ts
+			return channel, ts, nil
 		},
 	}
-	slackService := &slackService{"token", "mychannel", true, func(token string) slackAdapter {
+	slackService := &slackService{token: "token", channel: "mychannel", apiProvider: func(token string) slackAdapter {
 		return mock
 	}}
-	err := slackService.PublishGroupsInSlack([][]ct.User{
-		[]ct.User{ct.User{ID: "ali"}, ct.User{ID: "veli"}},
-	})
-
-	if err != nil {
+	if err := slackService.DeleteMessage(context.Background(), "1571400000.000200"); err != nil {
 		t.Fatal(err)
 	}
-	if inputChannel != "mychannel" {
-		t.Fatalf("Channel is expected: mychannel but was: %s", inputChannel)
-	}
-	expectedText := fmt.Sprintf("Coffee time! Today's groups: \n*Group 1:* <@ali>, <@veli>\n\nZoom up!")
-	if inputText != expectedText {
-		t.Fatalf("Text is exptected to be: %s but was: %s", expectedText, inputText)
+	if inputChannel != "mychannel" || inputTs != "1571400000.000200" {
+		t.Fatalf("Message 1571400000.000200 in mychannel should be deleted but was: %s in %s", inputTs, inputChannel)
 	}
 }
 
 type mockSlack struct {
-	getChannelMembers func(channel string) ([]string, error)
-	getGroupMembers   func(group string) ([]string, error)
-	getUserInfo       func(user string) (*slack.User, error)
-	postMessage       func(channel string, text string, params slack.PostMessageParameters) (string, string, error)
+	getConversationMembers func(ctx context.Context, channel string, cursor string) ([]string, string, error)
+	getUsers               func(ctx context.Context) ([]slack.User, error)
+	postMessage            func(ctx context.Context, channel string, text string, blocks []slack.Block, params slack.PostMessageParameters) (string, string, error)
+	deleteMessage          func(ctx context.Context, channel string, ts string) (string, string, error)
 }
 
-func (m *mockSlack) GetChannelMembers(channel string) ([]string, error) {
-	return m.getChannelMembers(channel)
+func (m *mockSlack) GetConversationMembers(ctx context.Context, channel string, cursor string) ([]string, string, error) {
+	return m.getConversationMembers(ctx, channel, cursor)
 }
 
-func (m *mockSlack) GetGroupMembers(group string) ([]string, error) {
-	return m.getGroupMembers(group)
+func (m *mockSlack) GetUsers(ctx context.Context) ([]slack.User, error) {
+	return m.getUsers(ctx)
 }
 
-func (m *mockSlack) GetUserInfo(user string) (*slack.User, error) {
-	return m.getUserInfo(user)
+func (m *mockSlack) PostMessage(ctx context.Context, channel string, text string, blocks []slack.Block, params slack.PostMessageParameters) (string, string, error) {
+	return m.postMessage(ctx, channel, text, blocks, params)
 }
 
-func (m *mockSlack) PostMessage(channel string, text string, params slack.PostMessageParameters) (string, string, error) {
-	return m.postMessage(channel, text, params)
+func (m *mockSlack) DeleteMessage(ctx context.Context, channel string, ts string) (string, string, error) {
+	return m.deleteMessage(ctx, channel, ts)
 }